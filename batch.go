@@ -0,0 +1,296 @@
+package main
+
+import (
+    "bufio"
+    "fmt"
+    "image"
+    "os"
+    "path/filepath"
+    "runtime"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    pserrors "github.com/faceplate-kleo/pixelsorter/lib/errors"
+    "github.com/faceplate-kleo/pixelsorter/lib/nrgbautil"
+    "github.com/faceplate-kleo/pixelsorter/src/core"
+)
+
+const defaultBatchOut = "./sorted/{name}_sorted.png"
+
+// imageExts are the files picked up from a directory.
+var imageExts = map[string]bool{".png": true, ".jpg": true, ".jpeg": true, ".gif": true}
+
+// batchItem is one input of a batch and where its output goes.
+type batchItem struct {
+    index int
+    in string
+    out string
+    maskOut string
+}
+
+// batchResult is how one item went. err is nil for items that were sorted
+// or skipped.
+type batchResult struct {
+    item batchItem
+    skipped bool
+    err error
+}
+
+func runBatch(args []string) error {
+    c := newRenderCmd("batch", "Sort every image of a directory, glob or file list with the same settings, in parallel. Inputs are -in and any further arguments.", defaultBatchOut)
+    workers := runtime.NumCPU()
+    listPath := ""
+    skipExisting := false
+    c.fs.IntVar(&workers, "workers", workers, "Number of images sorted at once")
+    c.fs.StringVar(&listPath, "list", "", "File with one input path per line")
+    c.fs.BoolVar(&skipExisting, "skip_existing", false, "Skip inputs whose output already exists")
+    c.fs.StringVar(&c.maskOut, "mask_out", "", "Name template for mask outputs - does not write if unspecified")
+    c.registerFormat()
+    //inputs and flags may be mixed
+    patterns := []string{}
+    for c.fs.Parse(args); c.fs.NArg() > 0; c.fs.Parse(args) {
+        patterns = append(patterns, c.fs.Arg(0))
+        args = c.fs.Args()[1:]
+    }
+    if workers < 1 {
+        return fmt.Errorf("%w: workers must be at least 1, got %d", pserrors.ErrInvalidOptions, workers)
+    }
+
+    recipe, err := c.recipe(nil)
+    if err != nil {
+        return err
+    }
+    if c.saveOnly(recipe) && len(patterns) == 0 {
+        return nil
+    }
+    if recipe.Input != "" {
+        patterns = append([]string{recipe.Input}, patterns...)
+    }
+    if listPath != "" {
+        listed, err := readList(listPath)
+        if err != nil {
+            return err
+        }
+        patterns = append(patterns, listed...)
+    }
+    inputs, err := expandInputs(patterns)
+    if err != nil {
+        return err
+    }
+    if len(inputs) == 0 {
+        return fmt.Errorf("no input images found in %s", strings.Join(patterns, ", "))
+    }
+    items, err := batchItems(inputs, orDefault(recipe.Output, defaultBatchOut), recipe.MaskOutput, recipe.Seed)
+    if err != nil {
+        return err
+    }
+    passes, err := recipe.ToPasses()
+    if err != nil {
+        return err
+    }
+
+    jobs := make(chan batchItem)
+    results := make(chan batchResult)
+    var wg sync.WaitGroup
+    for w := 0; w < workers; w++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            for item := range jobs {
+                result := batchResult{item: item}
+                if skipExisting && exists(item.out) {
+                    result.skipped = true
+                } else {
+                    result.err = sortFile(item, passes, recipe)
+                }
+                results <- result
+            }
+        }()
+    }
+    go func() {
+        for _, item := range items {
+            jobs <- item
+        }
+        close(jobs)
+        wg.Wait()
+        close(results)
+    }()
+
+    progress := progressBar("batch", "images")
+    start := time.Now()
+    failed := []batchResult{}
+    done, skipped := 0, 0
+    for result := range results {
+        done++
+        if result.skipped {
+            skipped++
+        }
+        if result.err != nil {
+            failed = append(failed, result)
+        }
+        progress(core.Progress{Done: done, Total: len(items), Elapsed: time.Since(start)})
+    }
+
+    fmt.Fprintf(os.Stderr, "batch: %d sorted, %d skipped, %d failed\n", done-skipped-len(failed), skipped, len(failed))
+    if len(failed) == 0 {
+        return nil
+    }
+    sort.Slice(failed, func(i, j int) bool {
+        return failed[i].item.index < failed[j].item.index
+    })
+    for _, result := range failed {
+        fmt.Fprintf(os.Stderr, "    %s: %v\n", result.item.in, result.err)
+    }
+    return fmt.Errorf("%d of %d inputs failed", len(failed), len(items))
+}
+
+// sortFile runs the passes over one input and writes its outputs.
+func sortFile(item batchItem, passes []core.Pass, recipe *core.Recipe) error {
+    single := *recipe
+    single.Input = item.in
+    imData, _, err := loadRecipe(&single)
+    if err != nil {
+        return err
+    }
+    sorted, mask, err := core.SortPasses(imData, passes)
+    if err != nil {
+        return err
+    }
+    if err := writeCreatingDir(sorted, item.out, recipe.Format); err != nil {
+        return err
+    }
+    if item.maskOut == "" {
+        return nil
+    }
+    if mask == nil {
+        return errNoMask
+    }
+    return writeCreatingDir(mask, item.maskOut, recipe.Format)
+}
+
+func writeCreatingDir(imData *image.NRGBA, path, format string) error {
+    if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+        return pserrors.IO("mkdir", filepath.Dir(path), err)
+    }
+    return nrgbautil.WriteFileFormat(imData, path, format)
+}
+
+// expandInputs turns directories, globs and plain paths into a list of image
+// files. Directories contribute the images directly inside them. Files are
+// listed once, in the order they are first named.
+func expandInputs(patterns []string) ([]string, error) {
+    inputs := []string{}
+    seen := map[string]bool{}
+    add := func(path string) {
+        if !seen[path] {
+            seen[path] = true
+            inputs = append(inputs, path)
+        }
+    }
+    for _, pattern := range patterns {
+        info, err := os.Stat(pattern)
+        switch {
+        case err == nil && info.IsDir():
+            entries, err := os.ReadDir(pattern)
+            if err != nil {
+                return nil, pserrors.IO("read", pattern, err)
+            }
+            for _, entry := range entries {
+                if !entry.IsDir() && imageExts[strings.ToLower(filepath.Ext(entry.Name()))] {
+                    add(filepath.Join(pattern, entry.Name()))
+                }
+            }
+        case err == nil || !hasMeta(pattern):
+            //missing files are reported with the other failures
+            add(pattern)
+        default:
+            matches, globErr := filepath.Glob(pattern)
+            if globErr != nil {
+                return nil, fmt.Errorf("%w: input pattern %q: %v", pserrors.ErrInvalidOptions, pattern, globErr)
+            }
+            if len(matches) == 0 {
+                return nil, fmt.Errorf("input pattern %q matches nothing", pattern)
+            }
+            for _, match := range matches {
+                if info, err := os.Stat(match); err == nil && !info.IsDir() {
+                    add(match)
+                }
+            }
+        }
+    }
+    return inputs, nil
+}
+
+// readList reads one path per line, skipping blank lines and # comments.
+func readList(path string) ([]string, error) {
+    file, err := os.Open(path)
+    if err != nil {
+        return nil, pserrors.IO("open", path, err)
+    }
+    defer file.Close()
+
+    paths := []string{}
+    scanner := bufio.NewScanner(file)
+    for scanner.Scan() {
+        line := strings.TrimSpace(scanner.Text())
+        if line != "" && !strings.HasPrefix(line, "#") {
+            paths = append(paths, line)
+        }
+    }
+    if err := scanner.Err(); err != nil {
+        return nil, pserrors.IO("read", path, err)
+    }
+    return paths, nil
+}
+
+// batchItems names the outputs of every input. Two inputs may not end up
+// with the same output.
+func batchItems(inputs []string, outTemplate, maskTemplate string, seed int64) ([]batchItem, error) {
+    items := make([]batchItem, len(inputs))
+    owners := map[string]string{}
+    for i, in := range inputs {
+        item := batchItem{index: i, in: in, out: expandName(outTemplate, in, i, seed)}
+        if maskTemplate != "" {
+            item.maskOut = expandName(maskTemplate, in, i, seed)
+        }
+        for _, out := range []string{item.out, item.maskOut} {
+            if out == "" {
+                continue
+            }
+            if owner, taken := owners[out]; taken {
+                return nil, fmt.Errorf("%w: %s and %s would both be written to %s, add {index} or {dir} to the name template",
+                    pserrors.ErrInvalidOptions, owner, in, out)
+            }
+            owners[out] = in
+        }
+        items[i] = item
+    }
+    return items, nil
+}
+
+// expandName fills in a name template. {name} is the input file name without
+// its extension, {ext} the extension without the dot, {dir} the directory of
+// the input, {index} its position in the batch and {seed} the seed.
+func expandName(template, in string, index int, seed int64) string {
+    base := filepath.Base(in)
+    ext := filepath.Ext(base)
+    return strings.NewReplacer(
+        "{name}", strings.TrimSuffix(base, ext),
+        "{ext}", strings.TrimPrefix(ext, "."),
+        "{dir}", filepath.Dir(in),
+        "{index}", strconv.Itoa(index),
+        "{seed}", strconv.FormatInt(seed, 10),
+    ).Replace(template)
+}
+
+func hasMeta(pattern string) bool {
+    return strings.ContainsAny(pattern, `*?[\`)
+}
+
+func exists(path string) bool {
+    _, err := os.Stat(path)
+    return err == nil
+}
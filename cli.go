@@ -0,0 +1,327 @@
+package main
+
+import (
+    "flag"
+    "fmt"
+    "os"
+    "strings"
+    "time"
+
+    pserrors "github.com/faceplate-kleo/pixelsorter/lib/errors"
+    f "github.com/faceplate-kleo/pixelsorter/lib/flags"
+    psmath "github.com/faceplate-kleo/pixelsorter/lib/math"
+    "github.com/faceplate-kleo/pixelsorter/lib/nrgbautil"
+    "github.com/faceplate-kleo/pixelsorter/lib/registry"
+    "github.com/faceplate-kleo/pixelsorter/src/core"
+)
+
+// sortFlags are the flags that describe a sort. The values it is created with
+// are the defaults of the flags.
+type sortFlags struct {
+    flags f.Flags
+    key string
+    maskPath string
+    maskGen string
+    threshold int
+    params paramList
+    direction string
+    scalar float64
+    noise int
+    spanOp string
+    mode string
+    scan string
+    aggregate string
+    region string
+    tiles string
+    block string
+    tileOp string
+    passes passList
+}
+
+func newSortFlags() *sortFlags {
+    return &sortFlags{
+        maskGen: "contrast",
+        threshold: 110,
+        params: paramList{},
+        direction: "right",
+        scalar: 3.0,
+        spanOp: "sort",
+        mode: "span",
+        scan: "row",
+        aggregate: "mean",
+        tileOp: "sort",
+    }
+}
+
+// registerMask adds the flags that decide the mask.
+func (s *sortFlags) registerMask(fs *flag.FlagSet) {
+    fs.StringVar(&s.maskPath, "mask", s.maskPath, "Path to mask input file - skips mask generation step")
+    fs.StringVar(&s.maskGen, "mask_gen", s.maskGen, "Registered mask generator used when no -mask is given. See the list below")
+    fs.IntVar(&s.threshold, "threshold", s.threshold, "Red channel threshold for the contrast mask")
+    fs.BoolVar(&s.flags.INVERT, "invert", false, "Invert the contrast mask")
+    fs.BoolVar(&s.flags.MASK_DEBUG, "mask_debug", false, "White-out the mask for debugging")
+    fs.Var(s.params, "param", "Set a parameter of a registered entry, e.g. \"length=40\". Repeatable")
+}
+
+// register adds every sort flag.
+func (s *sortFlags) register(fs *flag.FlagSet) {
+    s.registerMask(fs)
+    fs.BoolVar(&s.flags.CRUSH, "crush", false, "Crush the output (bug turned feature)")
+    fs.BoolVar(&s.flags.DEBUG, "span_debug", false, "Fill spans with random colors for debugging")
+    fs.BoolVar(&s.flags.DESCEND, "descend", false, "Sort pixels in descending order")
+    fs.BoolVar(&s.flags.CLEAN, "clean", false, "Limit sorting to only within mask, with no bleeding")
+    fs.BoolVar(&s.flags.MEAN_COMPARE, "mean_compare", true, "Base pixel comparisons on R+G+B/3")
+    fs.BoolVar(&s.flags.GRAY_RED_COMPARE, "red_compare", false, "Base pixel comparions on just R - defaults false, overrides mean_compare")
+    fs.StringVar(&s.key, "key", s.key, "Registered sort key, e.g. mean, red, hue - overrides mean_compare and red_compare. See the list below")
+    fs.StringVar(&s.spanOp, "span_op", s.spanOp, "Registered op applied to every span. See the list below")
+    fs.StringVar(&s.direction, "direction", s.direction, "Direction of sort smear (up, down, left, right)")
+    fs.Float64Var(&s.scalar, "scalar", s.scalar, "Scale factor of sort span sizing")
+    fs.IntVar(&s.noise, "noise", s.noise, "Random noise span offset amount in pixels")
+    fs.StringVar(&s.mode, "mode", s.mode, "Sort mode: span (sort runs of masked pixels), tiles, rows or cols (reorder whole rows/columns by -aggregate), or regions (sort connected mask regions as a whole)")
+    fs.StringVar(&s.scan, "scan", s.scan, "Order sorted pixels are written back into each region in regions mode: row, col or radial")
+    fs.StringVar(&s.aggregate, "aggregate", s.aggregate, "Line key for the rows and cols modes: mean, median, variance or mask (count of mask pixels)")
+    fs.StringVar(&s.region, "region", s.region, "Only sort inside the rectangle x,y,w,h, e.g. 100,50,300,200 - the rest of the image is left untouched")
+    fs.StringVar(&s.tiles, "tiles", s.tiles, "Split the image into a grid of COLSxROWS tiles, e.g. 8x8")
+    fs.StringVar(&s.block, "block", s.block, "Split the image into blocks of WxH pixels, e.g. 32x32 - overrides -tiles")
+    fs.StringVar(&s.tileOp, "tile_op", s.tileOp, "What to do with tiles: sort (sort inside each tile) or arrange (reorder whole tiles by average key along the sort direction)")
+    fs.StringVar(&s.flags.ANCHOR, "anchor", "start", "Where spans are anchored on a mask run: start (smear forward), end (smear backwards), center (grow both ways) or bidirectional (grow both ways, ascending to the middle then descending)")
+    fs.Var(&s.passes, "pass", "Add a sort pass, e.g. \"direction=down,key=red,threshold=80,scalar=1.5,noise=4,mask=m.png,invert,clean,descend,keep_mask\". Repeat for multiple passes; unset values fall back to the flags above")
+}
+
+// pass is the pass the flags describe on their own.
+func (s *sortFlags) pass(seed int64) (core.Pass, error) {
+    opts := core.OptionsFromFlags(s.flags)
+    opts.Direction = s.direction
+    opts.Threshold = s.threshold
+    opts.Scalar = s.scalar
+    opts.NoiseFactor = s.noise
+    opts.MaskPath = s.maskPath
+    opts.Mode = s.mode
+    opts.TileOp = s.tileOp
+    opts.Aggregate = s.aggregate
+    opts.Scan = s.scan
+    opts.Seed = seed
+    opts.MaskGen = s.maskGen
+    opts.SpanOp = s.spanOp
+    opts.Params = s.params
+    if s.key != "" {
+        opts.Key = s.key
+    }
+    var err error
+    if s.region != "" {
+        if opts.Region, err = core.ParseRegion(s.region); err != nil {
+            return core.Pass{}, err
+        }
+    }
+
+    base := core.Pass{Options: opts, RecomputeMask: true}
+    if s.tiles != "" || s.block != "" {
+        if s.mode == "span" {
+            base.Mode = "tiles"
+        }
+        if s.tiles != "" {
+            if base.Grid, err = core.ParseSize(s.tiles); err != nil {
+                return core.Pass{}, err
+            }
+        }
+        if s.block != "" {
+            if base.Block, err = core.ParseSize(s.block); err != nil {
+                return core.Pass{}, err
+            }
+        }
+    }
+    return base, nil
+}
+
+// passList is every pass of the sort: the -pass specs on top of base, or
+// base alone.
+func (s *sortFlags) passList(base core.Pass) ([]core.Pass, error) {
+    if len(s.passes) == 0 {
+        return []core.Pass{base}, nil
+    }
+    passes := make([]core.Pass, len(s.passes))
+    for i, spec := range s.passes {
+        pass, err := core.ParsePass(spec, base)
+        if err != nil {
+            return nil, err
+        }
+        passes[i] = pass
+    }
+    return passes, nil
+}
+
+// renderCmd is the flag set shared by the commands that render a recipe:
+// input and output, the seed, recipe files and the sort itself.
+type renderCmd struct {
+    fs *flag.FlagSet
+    in string
+    out string
+    maskOut string
+    seed int64
+    sourceDebug bool
+    recipePath string
+    dumpRecipe string
+    preset string
+    savePreset string
+    format string
+    preview previewFlags
+    watch bool
+    watchInterval time.Duration
+    dryRun bool
+    // fallbackSeed is used when neither the flags nor a recipe set a seed.
+    fallbackSeed int64
+    // rebuilt is set once the recipe is built again by -watch, which does
+    // not write -dump-recipe and -save-preset a second time.
+    rebuilt bool
+    sort *sortFlags
+}
+
+// newRenderCmd sets up the flags of a command. defaultOut is only shown in
+// the help; an empty -out means the default of the command.
+func newRenderCmd(name, summary, defaultOut string) *renderCmd {
+    c := &renderCmd{fs: flag.NewFlagSet(name, flag.ExitOnError), sort: newSortFlags()}
+    c.fs.StringVar(&c.in, "in", "", "Path to file to sort, - for standard input - REQUIRED")
+    c.fs.StringVar(&c.out, "out", "", "Path to output file, - for standard output (default "+defaultOut+")")
+    c.fs.Int64Var(&c.seed, "seed", 0, "Seed for all randomness (noise, debug colors). The same seed reproduces the same output; 0 picks one and prints it")
+    c.fs.BoolVar(&c.sourceDebug, "source_debug", false, "Replace the input data with random color noise for debugging")
+    c.fs.StringVar(&c.recipePath, "recipe", "", "Render from a JSON recipe file. Flags given explicitly override its settings, for every pass")
+    c.fs.StringVar(&c.dumpRecipe, "dump-recipe", "", "Write the effective recipe of this invocation to a JSON file (- for stdout) before rendering")
+    c.fs.StringVar(&c.preset, "preset", "", "Start from a named preset, e.g. melt, rain, glass or vhs. Flags given explicitly override it. See the presets command")
+    c.fs.StringVar(&c.savePreset, "save-preset", "", "Save the passes of this invocation as a user preset under this name. Without -in nothing is rendered")
+    c.sort.register(c.fs)
+    c.fs.Usage = commandUsage(c.fs, summary, true)
+    return c
+}
+
+// recipe builds the recipe the command renders: the flags alone, or a
+// recipe file with the explicitly given flags on top. animation is what the
+// flags ask for, nil for a still image. The recipe is validated, has a seed,
+// and is dumped and saved as a preset if asked, the first time it is built.
+// The input is checked when it is loaded.
+func (c *renderCmd) recipe(animation *core.RecipeAnimation) (*core.Recipe, error) {
+    base, err := c.sort.pass(c.seed)
+    if err != nil {
+        return nil, err
+    }
+    passes, err := c.sort.passList(base)
+    if err != nil {
+        return nil, err
+    }
+    recipe := core.NewRecipe(passes...)
+    recipe.Input = c.in
+    recipe.SourceDebug = c.sourceDebug
+    recipe.Animation = animation
+    if animation == nil {
+        recipe.Output = c.out
+        recipe.MaskOutput = c.maskOut
+        recipe.Format = c.format
+    }
+
+    var loaded *core.Recipe
+    switch {
+    case c.recipePath != "" && c.preset != "":
+        return nil, fmt.Errorf("%w: -recipe and -preset can not be combined", pserrors.ErrInvalidOptions)
+    case c.recipePath != "":
+        loaded, err = core.LoadRecipe(c.recipePath)
+    case c.preset != "":
+        loaded, err = core.LoadPreset(c.preset)
+    }
+    if err != nil {
+        return nil, err
+    }
+    if loaded != nil {
+        overlayFlags(c.fs, loaded, recipe, core.RecipePassFrom(base))
+        recipe = loaded
+    }
+
+    if recipe.Seed == 0 {
+        recipe.Seed = c.fallbackSeed
+    }
+    if recipe.Seed == 0 {
+        recipe.Seed = psmath.RandomSeed()
+    }
+    fmt.Fprintln(os.Stderr, "seed:", recipe.Seed)
+    if err := recipe.Validate(); err != nil {
+        return nil, err
+    }
+    if err := c.checkStdio(recipe); err != nil {
+        return nil, err
+    }
+    if c.rebuilt {
+        return recipe, nil
+    }
+    if c.dumpRecipe != "" {
+        if err := writeRecipe(recipe, c.dumpRecipe); err != nil {
+            return nil, err
+        }
+    }
+    if c.savePreset != "" {
+        seedSet := false
+        c.fs.Visit(func(fl *flag.Flag) {
+            seedSet = seedSet || fl.Name == "seed"
+        })
+        saved := *recipe
+        saved.Description = ""
+        if c.preset != "" {
+            saved.Description = "Based on " + c.preset
+        }
+        path, err := core.SavePreset(c.savePreset, &saved, seedSet)
+        if err != nil {
+            return nil, err
+        }
+        fmt.Fprintf(os.Stderr, "saved preset %s to %s\n", c.savePreset, path)
+    }
+    return recipe, nil
+}
+
+// registerFormat adds -format for the commands that write still images.
+func (c *renderCmd) registerFormat() {
+    c.fs.StringVar(&c.format, "format", "", "Image format of the outputs: "+strings.Join(nrgbautil.Formats, ", ")+" (default png)")
+}
+
+// checkStdio makes sure standard input is read at most once and standard
+// output gets at most one output.
+func (c *renderCmd) checkStdio(recipe *core.Recipe) error {
+    if c.watch && recipe.Input == "-" {
+        return fmt.Errorf("%w: -watch can not watch standard input, give -in a file", pserrors.ErrInvalidOptions)
+    }
+    if c.dryRun {
+        if c.dumpRecipe == "-" {
+            return fmt.Errorf("%w: -dry-run reports on standard output, -dump-recipe can not use it too", pserrors.ErrInvalidOptions)
+        }
+        return nil
+    }
+    outputs := []string{recipe.Output, recipe.MaskOutput, c.dumpRecipe}
+    if recipe.Animation != nil {
+        outputs = append(outputs, recipe.Animation.Output)
+    }
+    stdout := 0
+    for _, out := range outputs {
+        if out == "-" {
+            stdout++
+        }
+    }
+    if stdout > 1 {
+        return fmt.Errorf("%w: only one of -out, -mask_out and -dump-recipe can be - (standard output)", pserrors.ErrInvalidOptions)
+    }
+    return nil
+}
+
+// saveOnly reports whether the command was only run to save a preset.
+func (c *renderCmd) saveOnly(recipe *core.Recipe) bool {
+    return c.savePreset != "" && recipe.Input == ""
+}
+
+// commandUsage prints the flags of a command, and the registered effects
+// for commands that sort.
+func commandUsage(fs *flag.FlagSet, summary string, effects bool) func() {
+    return func() {
+        out := fs.Output()
+        fmt.Fprintf(out, "Usage of %s %s:\n    %s\n\n", os.Args[0], fs.Name(), summary)
+        fs.PrintDefaults()
+        if effects {
+            fmt.Fprintln(out)
+            registry.DescribeAll(out)
+        }
+    }
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "flag"
+    "fmt"
+    "image"
+    "io"
+    "os"
+    "os/signal"
+    "strings"
+
+    "github.com/faceplate-kleo/pixelsorter/lib/anim"
+    pserrors "github.com/faceplate-kleo/pixelsorter/lib/errors"
+    f "github.com/faceplate-kleo/pixelsorter/lib/flags"
+    psgif "github.com/faceplate-kleo/pixelsorter/lib/gif"
+    "github.com/faceplate-kleo/pixelsorter/lib/nrgbautil"
+    "github.com/faceplate-kleo/pixelsorter/src/core"
+)
+
+// Default outputs of the commands, used when neither -out nor a recipe names
+// one.
+const (
+    defaultStillOut = "./sorted.png"
+    defaultGifOut = "./sorted.gif"
+    defaultFramesOut = "./frames/"
+    defaultMaskOut = "./mask.png"
+    defaultVisualizationOut = "./visualization.gif"
+    defaultSpectrogramOut = "./spectrogram.png"
+)
+
+// command is one subcommand of the CLI.
+type command struct {
+    name string
+    summary string
+    run func(args []string) error
+}
+
+var commands = []command{
+    {"sort", "Sort a still image, in one or more passes", runSort},
+    {"animate", "Render an animation of the sort with fresh noise every frame", runAnimate},
+    {"audio", "Render an animation with span lengths driven by a .wav file", runAudio},
+    {"mask", "Write the mask a sort would use, without sorting", runMask},
+    {"batch", "Sort every image of a directory, glob or file list in parallel", runBatch},
+    {"sweep", "Render combinations of settings into one labelled contact sheet", runSweep},
+    {"presets", "List the built-in and user presets", runPresets},
+    {"visualize", "Render a .wav file as a bar spectrum, oscilloscope or spectrogram", runVisualize},
+    {"serve", "Serve a web page for tuning a sort, and an HTTP API for rendering", runServe},
+}
+
+func runSort(args []string) error {
+    c := newRenderCmd("sort", "Sort a still image, in one or more passes.", defaultStillOut)
+    c.fs.StringVar(&c.maskOut, "mask_out", "", "Path to mask output file - does not write if unspecified")
+    c.registerFormat()
+    c.preview.register(c.fs)
+    c.registerWatch()
+    c.registerDryRun()
+    c.fs.Parse(args)
+
+    build := func() (*core.Recipe, error) {
+        return c.recipe(nil)
+    }
+    recipe, err := build()
+    if err != nil {
+        return err
+    }
+    if c.saveOnly(recipe) {
+        return nil
+    }
+    if c.dryRun {
+        return planRender(recipe)
+    }
+    if c.watch {
+        cache := &stillCache{}
+        return c.watchLoop(recipe, build, func(recipe *core.Recipe) error {
+            return renderStill(recipe, cache, &c.preview)
+        })
+    }
+    return renderStill(recipe, nil, &c.preview)
+}
+
+func runAnimate(args []string) error {
+    c := newRenderCmd("animate", "Render an animation of the first pass, sorted again with fresh noise every frame.", defaultGifOut+", or "+defaultFramesOut+" for frames")
+    animation := &core.RecipeAnimation{}
+    c.fs.IntVar(&animation.Frames, "frames", 10, "The number of frames to generate")
+    c.fs.StringVar(&animation.Format, "format", "gif", "Animation output format: "+strings.Join(anim.Formats, ", ")+" (numbered .pngs in the -out directory)")
+    c.registerWatch()
+    c.registerDryRun()
+    c.fs.Parse(args)
+    animation.Output = c.out
+
+    build := func() (*core.Recipe, error) {
+        recipe, err := c.recipe(animation)
+        if err != nil {
+            return nil, err
+        }
+        recipe.Animation.Audio = nil
+        return recipe, nil
+    }
+    return c.renderAnimations(build)
+}
+
+func runAudio(args []string) error {
+    c := newRenderCmd("audio", "Render an animation from the first pass, with span lengths driven by a .wav file.", defaultGifOut+", or "+defaultFramesOut+" for frames")
+    animation := &core.RecipeAnimation{Frames: 10, Audio: &core.RecipeAudio{}}
+    c.fs.StringVar(&animation.Audio.Wav, "wav", "", "Filepath of a .wav file - REQUIRED")
+    c.fs.IntVar(&animation.Audio.Framerate, "framerate", 25, "Desired framerate of output .GIF (Warning: values n for 100 % n != 0 will cause time drift with audio!)")
+    c.fs.IntVar(&animation.Audio.Buckets, "buckets", 128, "The number of frequency bands to divide .wav signal into")
+    c.fs.StringVar(&animation.Format, "format", "gif", "Animation output format: "+strings.Join(anim.Formats, ", ")+" (numbered .pngs in the -out directory)")
+    c.registerWatch()
+    c.registerDryRun()
+    c.fs.Parse(args)
+    animation.Output = c.out
+    //with a recipe or preset naming the .wav, -framerate and -buckets still
+    //apply to it
+    if animation.Audio.Wav == "" && c.recipePath == "" && c.preset == "" {
+        if c.savePreset == "" {
+            return errors.New("no .wav file specified! ( -wav )")
+        }
+        animation.Audio = nil
+    }
+
+    build := func() (*core.Recipe, error) {
+        recipe, err := c.recipe(animation)
+        if err != nil {
+            return nil, err
+        }
+        if recipe.Animation.Audio == nil && !c.saveOnly(recipe) {
+            return nil, errors.New("no .wav file specified! ( -wav )")
+        }
+        return recipe, nil
+    }
+    return c.renderAnimations(build)
+}
+
+// renderAnimations renders the recipe of an animating command, once or in
+// watch mode.
+func (c *renderCmd) renderAnimations(build func() (*core.Recipe, error)) error {
+    recipe, err := build()
+    if err != nil {
+        return err
+    }
+    if c.saveOnly(recipe) {
+        return nil
+    }
+    if c.dryRun {
+        return planRender(recipe)
+    }
+    if c.watch {
+        return c.watchLoop(recipe, build, renderAnimation)
+    }
+    return renderAnimation(recipe)
+}
+
+func runMask(args []string) error {
+    fs := flag.NewFlagSet("mask", flag.ExitOnError)
+    inPath := ""
+    outPath := ""
+    direction := "right"
+    format := ""
+    sort := newSortFlags()
+    fs.StringVar(&inPath, "in", "", "Path to the image to mask, - for standard input - REQUIRED")
+    fs.StringVar(&outPath, "out", "", "Path to mask output file, - for standard output (default "+defaultMaskOut+")")
+    fs.StringVar(&format, "format", "", "Image format of the mask: "+strings.Join(nrgbautil.Formats, ", ")+" (default png)")
+    preview := previewFlags{}
+    preview.register(fs)
+    fs.StringVar(&direction, "direction", direction, "Direction of the sort the mask is for (up, down, left, right)")
+    sort.registerMask(fs)
+    fs.Usage = commandUsage(fs, "Write the mask a sort would use, without sorting. White pixels are sorted.", true)
+    fs.Parse(args)
+
+    if inPath == "" {
+        return errors.New("no input file specified! ( -in )")
+    }
+    if !nrgbautil.KnownFormat(format) {
+        return fmt.Errorf("%w: image format %q, expected one of %s", pserrors.ErrUnsupportedFormat, format, strings.Join(nrgbautil.Formats, ", "))
+    }
+    sort.direction = direction
+    pass, err := sort.pass(0)
+    if err != nil {
+        return err
+    }
+    sorter, err := core.NewSorter(pass.Options)
+    if err != nil {
+        return err
+    }
+    imData, err := nrgbautil.LoadImage(inPath)
+    if err != nil {
+        return err
+    }
+    mask, err := sorter.Mask(nrgbautil.ToNrgba(imData))
+    if err != nil {
+        return err
+    }
+    if err := nrgbautil.WriteFileFormat(mask, orDefault(outPath, defaultMaskOut), format); err != nil {
+        return err
+    }
+    return preview.show(mask)
+}
+
+func runVisualize(args []string) error {
+    fs := flag.NewFlagSet("visualize", flag.ExitOnError)
+    wavPath := ""
+    outPath := ""
+    format := "gif"
+    size := "512x512"
+    gradient := "heat"
+    opts := psgif.DefaultVisualOptions()
+    fs.StringVar(&wavPath, "wav", "", "Filepath of a .wav file, - for standard input - REQUIRED")
+    fs.StringVar(&outPath, "out", "", "Path to output file, - for standard output (default "+defaultVisualizationOut+", "+defaultFramesOut+" for frames or "+defaultSpectrogramOut+" for png)")
+    fs.StringVar(&opts.Mode, "mode", opts.Mode, "What to draw: "+strings.Join(psgif.Modes, ", "))
+    fs.StringVar(&format, "format", format, "Output format: gif, frames (numbered .pngs in the -out directory) or png (the whole file as one spectrogram image, -mode spectrogram only)")
+    fs.StringVar(&size, "size", size, "Size of every frame, or of the png, as WxH")
+    fs.IntVar(&opts.Framerate, "framerate", opts.Framerate, "Frames per second, as for the audio command")
+    fs.IntVar(&opts.Buckets, "buckets", opts.Buckets, "The number of frequency bands to divide .wav signal into, as for the audio command")
+    fs.StringVar(&opts.Scale, "scale", opts.Scale, "Frequency scale: "+strings.Join(psgif.Scales, ", "))
+    fs.StringVar(&gradient, "gradient", gradient, "Colour gradient from quiet to loud: heat, ice, green, gray or hex colours such as 000000,ff0000,ffffff")
+    fs.Usage = commandUsage(fs, "Render a .wav file as a bar spectrum, oscilloscope or spectrogram, to check which bands will drive an audio sort.", false)
+    fs.Parse(args)
+
+    if wavPath == "" {
+        return errors.New("no .wav file specified! ( -wav )")
+    }
+    var err error
+    if opts.Size, err = core.ParseSize(size); err != nil {
+        return fmt.Errorf("%w: %v", pserrors.ErrInvalidOptions, err)
+    }
+    if opts.Gradient, err = psgif.ParseGradient(gradient); err != nil {
+        return err
+    }
+    if err := opts.Validate(); err != nil {
+        return err
+    }
+    still := strings.EqualFold(format, "png")
+    if still && !strings.EqualFold(opts.Mode, "spectrogram") {
+        return fmt.Errorf("%w: -format png draws a single spectrogram, use -mode spectrogram or -format frames", pserrors.ErrInvalidOptions)
+    }
+
+    var wav io.Reader = os.Stdin
+    if wavPath != "-" {
+        wavfile, err := os.Open(wavPath)
+        if err != nil {
+            return pserrors.IO("open", wavPath, err)
+        }
+        defer wavfile.Close()
+        wav = wavfile
+    }
+    if still {
+        img, err := psgif.Spectrogram(wav, opts)
+        if err != nil {
+            return err
+        }
+        return nrgbautil.WriteFile(img, orDefault(outPath, defaultSpectrogramOut))
+    }
+
+    if outPath == "" {
+        outPath = defaultVisualizationOut
+        if !strings.EqualFold(format, "gif") {
+            outPath = defaultFramesOut
+        }
+    }
+    return anim.Render(format, outPath, func(sink anim.FrameSink) error {
+        return psgif.Visualize(wav, sink, opts)
+    })
+}
+
+func runPresets(args []string) error {
+    fs := flag.NewFlagSet("presets", flag.ExitOnError)
+    fs.Usage = commandUsage(fs, "List the built-in and user presets. Apply one with -preset NAME, and save your own with -save-preset NAME.", false)
+    fs.Parse(args)
+
+    presets, err := core.ListPresets()
+    if err != nil {
+        return err
+    }
+    for _, preset := range presets {
+        fmt.Printf("%-14s %s\n", preset.Name, preset.Description)
+        if !preset.Builtin {
+            fmt.Printf("%-14s (user preset, %s)\n", "", preset.Path)
+        }
+    }
+    if dir, err := core.PresetDir(); err == nil {
+        fmt.Printf("\nUser presets are saved to %s\n", dir)
+    }
+    return nil
+}
+
+// errNoMask is returned for a mask output when the last pass used no mask,
+// as rows and cols do unless given one.
+var errNoMask = fmt.Errorf("%w: the last pass reorders whole lines without a mask, there is no mask to write", pserrors.ErrInvalidOptions)
+
+// loadRecipe reads the input of a validated recipe and returns it with the
+// passes to run on it.
+func loadRecipe(recipe *core.Recipe) (*image.NRGBA, []core.Pass, error) {
+    if recipe.Input == "" {
+        return nil, nil, errors.New("no input file specified! ( -in )")
+    }
+    imData, err := nrgbautil.LoadImage(recipe.Input)
+    if err != nil {
+        return nil, nil, err
+    }
+    passes, err := recipe.ToPasses()
+    if err != nil {
+        return nil, nil, err
+    }
+    return nrgbautil.DataToNrgbaSeeded(imData, f.Flags{SOURCE_DEBUG: recipe.SourceDebug}, recipe.Seed), passes, nil
+}
+
+// renderAnimation renders the animation of a recipe with its first pass.
+// ctrl-c stops queued frames, and whatever was finished is still written.
+func renderAnimation(recipe *core.Recipe) error {
+    imData, passes, err := loadRecipe(recipe)
+    if err != nil {
+        return err
+    }
+    animation := recipe.Animation
+    animOut := animation.Output
+    if animOut == "" {
+        animOut = defaultGifOut
+        if !strings.EqualFold(animation.Format, "gif") {
+            animOut = defaultFramesOut
+        }
+    }
+    ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+    defer stop()
+    opts := passes[0].Options
+    return anim.Render(animation.Format, animOut, func(sink anim.FrameSink) error {
+        if audio := animation.Audio; audio != nil {
+            return renderWave(ctx, imData, audio.Wav, sink, opts, audio.Framerate, audio.Buckets)
+        }
+        return core.Animation(ctx, imData, sink, opts, animation.Frames, progressBar("sorting", "frames"))
+    })
+}
+
+func renderWave(ctx context.Context, imData image.Image, wavPath string, sink anim.FrameSink, opts core.Options, framerate, buckets int) error {
+    wavfile, err := os.Open(wavPath)
+    if err != nil {
+        return pserrors.IO("open", wavPath, err)
+    }
+    defer wavfile.Close()
+
+    return core.WaveAnimation(ctx, imData, wavfile, sink, opts, framerate, buckets, progressBar("rendering", "frames"))
+}
+
+func orDefault(path, fallback string) string {
+    if path == "" {
+        return fallback
+    }
+    return path
+}
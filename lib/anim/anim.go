@@ -0,0 +1,176 @@
+package anim
+
+import (
+    "fmt"
+    "image"
+    "image/color"
+    "image/color/palette"
+    "image/draw"
+    "image/gif"
+    "io"
+    "os"
+    "path/filepath"
+    "strings"
+    "sync"
+
+    pserrors "github.com/faceplate-kleo/pixelsorter/lib/errors"
+    "github.com/faceplate-kleo/pixelsorter/lib/nrgbautil"
+)
+
+// FrameSink receives the frames of an animation. Frames may arrive out of
+// order and from several goroutines at once. delay is how long the frame is
+// shown, in 100ths of a second.
+type FrameSink interface {
+    WriteFrame(index int, frame image.Image, delay int) error
+    // Close finishes the animation. Sinks that assemble frames in memory
+    // write out every frame up to the first one that is missing.
+    Close() error
+}
+
+// DelayFor is the frame delay that comes closest to framerate.
+func DelayFor(framerate int) int {
+    if framerate <= 0 {
+        return 0
+    }
+    return int(1.0 / float64(framerate) * 100.0)
+}
+
+// GifSink collects paletted frames and encodes them as one GIF on Close.
+// Frames that are already paletted are kept as they are.
+type GifSink struct {
+    w io.Writer
+    palette color.Palette
+    closer io.Closer
+
+    mu sync.Mutex
+    frames []*image.Paletted
+    delays []int
+}
+
+// NewGifSink writes a GIF to w. A nil palette means palette.Plan9.
+func NewGifSink(w io.Writer, pal color.Palette) *GifSink {
+    if pal == nil {
+        pal = palette.Plan9
+    }
+    return &GifSink{w: w, palette: pal}
+}
+
+func (s *GifSink) WriteFrame(index int, frame image.Image, delay int) error {
+    paletted, ok := frame.(*image.Paletted)
+    if !ok {
+        paletted = image.NewPaletted(frame.Bounds(), s.palette)
+        draw.Draw(paletted, paletted.Rect, frame, frame.Bounds().Min, draw.Over)
+    }
+
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    for len(s.frames) <= index {
+        s.frames = append(s.frames, nil)
+        s.delays = append(s.delays, 0)
+    }
+    s.frames[index] = paletted
+    s.delays[index] = delay
+    return nil
+}
+
+// Frames is the number of frames Close will write.
+func (s *GifSink) Frames() int {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    finished := 0
+    for finished < len(s.frames) && s.frames[finished] != nil {
+        finished++
+    }
+    return finished
+}
+
+func (s *GifSink) Close() error {
+    finished := s.Frames()
+    var err error
+    if finished > 0 {
+        outGif := &gif.GIF{}
+        outGif.Image = s.frames[:finished]
+        outGif.Delay = s.delays[:finished]
+        if encodeErr := gif.EncodeAll(s.w, outGif); encodeErr != nil {
+            err = pserrors.IO("encode gif", "", encodeErr)
+        }
+    }
+    if s.closer != nil {
+        if closeErr := s.closer.Close(); err == nil && closeErr != nil {
+            err = pserrors.IO("close", "", closeErr)
+        }
+    }
+    return err
+}
+
+// PngSink writes every frame straight away as a numbered PNG file, e.g.
+// FRAME_12.png, so that tools like ffmpeg pick them up in order.
+type PngSink struct {
+    dir string
+    pattern string
+}
+
+// NewPngSink writes frames into dir, which is created if needed. pattern is a
+// fmt pattern for the file name; an empty pattern means "FRAME_%d.png".
+func NewPngSink(dir, pattern string) (*PngSink, error) {
+    if pattern == "" {
+        pattern = "FRAME_%d.png"
+    }
+    if err := os.MkdirAll(dir, 0o755); err != nil {
+        return nil, pserrors.IO("mkdir", dir, err)
+    }
+    return &PngSink{dir: dir, pattern: pattern}, nil
+}
+
+func (s *PngSink) WriteFrame(index int, frame image.Image, delay int) error {
+    path := filepath.Join(s.dir, fmt.Sprintf(s.pattern, index))
+    return nrgbautil.WriteFile(nrgbautil.ToNrgba(frame), path)
+}
+
+func (s *PngSink) Close() error {
+    return nil
+}
+
+// Formats lists the names Create understands.
+var Formats = []string{"gif", "frames"}
+
+// Create opens a sink by format name: "gif" writes a GIF file at path, or to
+// standard output for "-", and "frames" writes numbered PNGs into the
+// directory at path.
+func Create(format, path string) (FrameSink, error) {
+    switch strings.ToLower(format) {
+    case "gif":
+        if path == "-" {
+            return NewGifSink(os.Stdout, nil), nil
+        }
+        file, err := os.Create(path)
+        if err != nil {
+            return nil, pserrors.IO("create", path, err)
+        }
+        sink := NewGifSink(file, nil)
+        sink.closer = file
+        return sink, nil
+    case "frames", "png":
+        if path == "-" {
+            return nil, fmt.Errorf("%w: frames need a directory, not standard output", pserrors.ErrInvalidOptions)
+        }
+        return NewPngSink(path, "")
+    }
+    return nil, fmt.Errorf("%w: animation format %q, expected one of %s",
+        pserrors.ErrUnsupportedFormat, format, strings.Join(Formats, ", "))
+}
+
+// Render opens a sink with Create, hands it to render and closes it. The sink
+// is closed even when render fails, so that the frames that were finished are
+// still written.
+func Render(format, path string, render func(sink FrameSink) error) error {
+    sink, err := Create(format, path)
+    if err != nil {
+        return err
+    }
+    err = render(sink)
+    if closeErr := sink.Close(); err == nil {
+        err = closeErr
+    }
+    return err
+}
@@ -0,0 +1,101 @@
+package errors
+
+import (
+    goerrors "errors"
+    "fmt"
+    "image"
+    "io/fs"
+)
+
+// Sentinel errors for errors.Is checks. Every error returned by the library
+// wraps one of these where it applies.
+var (
+    ErrUnsupportedFormat = goerrors.New("unsupported format")
+    ErrBadWavHeader = goerrors.New("bad wav header")
+    ErrMaskSize = goerrors.New("mask size mismatch")
+    ErrIO = goerrors.New("i/o error")
+    ErrInvalidOptions = goerrors.New("invalid options")
+)
+
+// IOError is a failed read, write, open or create.
+type IOError struct {
+    Op string
+    Path string
+    Err error
+}
+
+func (e *IOError) Error() string {
+    var pathErr *fs.PathError
+    if goerrors.As(e.Err, &pathErr) {
+        return fmt.Sprintf("%s: %v", e.Op, e.Err)
+    }
+    if e.Path == "" {
+        return fmt.Sprintf("%s: %v", e.Op, e.Err)
+    }
+    return fmt.Sprintf("%s %s: %v", e.Op, e.Path, e.Err)
+}
+
+func (e *IOError) Unwrap() error {
+    return e.Err
+}
+
+func (e *IOError) Is(target error) bool {
+    return target == ErrIO
+}
+
+func IO(op, path string, err error) error {
+    if err == nil {
+        return nil
+    }
+    return &IOError{Op: op, Path: path, Err: err}
+}
+
+// FormatError is input that could not be decoded as any known format.
+type FormatError struct {
+    Path string
+    Err error
+}
+
+func (e *FormatError) Error() string {
+    if e.Path == "" {
+        return fmt.Sprintf("decode: %v", e.Err)
+    }
+    return fmt.Sprintf("decode %s: %v", e.Path, e.Err)
+}
+
+func (e *FormatError) Unwrap() error {
+    return e.Err
+}
+
+func (e *FormatError) Is(target error) bool {
+    return target == ErrUnsupportedFormat
+}
+
+// WavHeaderError is a WAV file whose header can not be used.
+type WavHeaderError struct {
+    Field string
+    Reason string
+}
+
+func (e *WavHeaderError) Error() string {
+    return fmt.Sprintf("bad wav header: %s: %s", e.Field, e.Reason)
+}
+
+func (e *WavHeaderError) Is(target error) bool {
+    return target == ErrBadWavHeader
+}
+
+// MaskSizeError is a mask whose size does not match the image it belongs to.
+type MaskSizeError struct {
+    Mask image.Rectangle
+    Image image.Rectangle
+}
+
+func (e *MaskSizeError) Error() string {
+    return fmt.Sprintf("mask size %dx%d does not match image size %dx%d",
+        e.Mask.Dx(), e.Mask.Dy(), e.Image.Dx(), e.Image.Dy())
+}
+
+func (e *MaskSizeError) Is(target error) bool {
+    return target == ErrMaskSize
+}
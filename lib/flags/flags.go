@@ -1,5 +1,7 @@
 package flags
 
+import "github.com/faceplate-kleo/pixelsorter/lib/registry"
+
 type Flags struct {
     DEBUG bool
     MASK_DEBUG bool
@@ -12,4 +14,11 @@ type Flags struct {
     INVERT bool
     MEAN_COMPARE bool
     GRAY_RED_COMPARE bool
+    ANCHOR string
+
+    // Registry entries resolved from the options. Nil falls back to the
+    // behaviour selected by the fields above.
+    KEY registry.KeyFunc
+    SPAN_OP registry.SpanFunc
+    INTERVAL registry.IntervalFunc
 }
@@ -0,0 +1,318 @@
+package gif
+
+import (
+    "encoding/hex"
+    "fmt"
+    "image"
+    "image/color"
+    "image/draw"
+    "io"
+    "math"
+    "sort"
+    "strings"
+
+    "github.com/faceplate-kleo/pixelsorter/lib/anim"
+    pserrors "github.com/faceplate-kleo/pixelsorter/lib/errors"
+    "github.com/faceplate-kleo/pixelsorter/lib/wave"
+)
+
+// Modes lists the visualization modes: a bar spectrum, an oscilloscope
+// waveform and a spectrogram scrolling from right to left.
+var Modes = []string{"bars", "scope", "spectrogram"}
+
+// Scales lists the frequency scales. log gives the low buckets more room.
+var Scales = []string{"linear", "log"}
+
+// Gradient maps 0..1 onto colours, from its first stop to its last.
+type Gradient []color.NRGBA
+
+// Gradients are the named gradients ParseGradient knows.
+var Gradients = map[string]Gradient{
+    "heat": {{0, 0, 0, 255}, {128, 0, 64, 255}, {255, 64, 0, 255}, {255, 200, 0, 255}, {255, 255, 255, 255}},
+    "ice": {{0, 0, 0, 255}, {0, 32, 128, 255}, {0, 160, 255, 255}, {255, 255, 255, 255}},
+    "green": {{0, 0, 0, 255}, {0, 96, 0, 255}, {0, 255, 0, 255}, {200, 255, 200, 255}},
+    "gray": {{0, 0, 0, 255}, {255, 255, 255, 255}},
+}
+
+// ParseGradient reads a gradient name, or two or more comma-separated hex
+// colours such as "000000,ff0000,ffffff".
+func ParseGradient(s string) (Gradient, error) {
+    if g, ok := Gradients[strings.ToLower(s)]; ok {
+        return g, nil
+    }
+    stops := strings.Split(s, ",")
+    if len(stops) < 2 {
+        names := make([]string, 0, len(Gradients))
+        for name := range Gradients {
+            names = append(names, name)
+        }
+        sort.Strings(names)
+        return nil, fmt.Errorf("%w: gradient %q is neither %s nor a list of hex colours",
+            pserrors.ErrInvalidOptions, s, strings.Join(names, ", "))
+    }
+    g := make(Gradient, len(stops))
+    for i, stop := range stops {
+        rgb, err := hex.DecodeString(strings.TrimPrefix(strings.TrimSpace(stop), "#"))
+        if err != nil || len(rgb) != 3 {
+            return nil, fmt.Errorf("%w: gradient colour %q is not of the form rrggbb", pserrors.ErrInvalidOptions, stop)
+        }
+        g[i] = color.NRGBA{rgb[0], rgb[1], rgb[2], 255}
+    }
+    return g, nil
+}
+
+// At is the colour at t, clamped to 0..1.
+func (g Gradient) At(t float64) color.NRGBA {
+    if t <= 0 || len(g) == 1 {
+        return g[0]
+    }
+    if t >= 1 {
+        return g[len(g)-1]
+    }
+    pos := t * float64(len(g)-1)
+    i := int(pos)
+    frac := pos - float64(i)
+    a, b := g[i], g[i+1]
+    mix := func(x, y uint8) uint8 {
+        return uint8(float64(x) + (float64(y)-float64(x))*frac + 0.5)
+    }
+    return color.NRGBA{mix(a.R, b.R), mix(a.G, b.G), mix(a.B, b.B), 255}
+}
+
+// VisualOptions configure Visualize and Spectrogram.
+type VisualOptions struct {
+    Mode string
+    // Size is the size of every frame, or of the spectrogram image.
+    Size image.Point
+    Framerate int
+    // Buckets is the number of frequency bands, as used for sorting.
+    Buckets int
+    Scale string
+    Gradient Gradient
+}
+
+// DefaultVisualOptions is a 512x512 bar spectrum at 25 frames per second.
+func DefaultVisualOptions() VisualOptions {
+    return VisualOptions{
+        Mode: "bars",
+        Size: image.Pt(512, 512),
+        Framerate: 25,
+        Buckets: 128,
+        Scale: "linear",
+        Gradient: Gradients["heat"],
+    }
+}
+
+func (o VisualOptions) Validate() error {
+    problems := []string{}
+    if !oneOf(o.Mode, Modes) {
+        problems = append(problems, fmt.Sprintf("mode %q, expected one of %s", o.Mode, strings.Join(Modes, ", ")))
+    }
+    if !oneOf(o.Scale, Scales) {
+        problems = append(problems, fmt.Sprintf("scale %q, expected one of %s", o.Scale, strings.Join(Scales, ", ")))
+    }
+    if o.Size.X <= 0 || o.Size.Y <= 0 {
+        problems = append(problems, fmt.Sprintf("size %dx%d must be positive", o.Size.X, o.Size.Y))
+    }
+    if o.Framerate <= 0 || o.Buckets <= 0 {
+        problems = append(problems, fmt.Sprintf("framerate %d and buckets %d must be positive", o.Framerate, o.Buckets))
+    }
+    if len(o.Gradient) == 0 {
+        problems = append(problems, "empty gradient")
+    }
+    if len(problems) > 0 {
+        return fmt.Errorf("%w: visualization: %s", pserrors.ErrInvalidOptions, strings.Join(problems, "; "))
+    }
+    return nil
+}
+
+func oneOf(value string, values []string) bool {
+    for _, v := range values {
+        if strings.EqualFold(v, value) {
+            return true
+        }
+    }
+    return false
+}
+
+// Visualize draws one frame per audio frame of a .wav stream and hands them
+// to sink. The caller closes the sink. Bars and the spectrogram show the same
+// buckets that drive a wave animation.
+func Visualize(wav io.Reader, sink anim.FrameSink, opts VisualOptions) error {
+    if err := opts.Validate(); err != nil {
+        return err
+    }
+    delay := anim.DelayFor(opts.Framerate)
+    emit := func(frame int, img image.Image) error {
+        return sink.WriteFrame(frame, img, delay)
+    }
+    if strings.EqualFold(opts.Mode, "scope") {
+        waveform, numFrames, err := wave.WaveformFromReader(wav, opts.Framerate)
+        if err != nil {
+            return err
+        }
+        if err := checkFrames(numFrames, opts.Framerate); err != nil {
+            return err
+        }
+        for frame := 0; frame < numFrames; frame++ {
+            if err := emit(frame, drawScope(waveform[frame], opts)); err != nil {
+                return err
+            }
+        }
+        return nil
+    }
+
+    waveStack, numFrames, err := wave.WaveStackFromReader(wav, opts.Framerate, opts.Buckets)
+    if err != nil {
+        return err
+    }
+    if err := checkFrames(numFrames, opts.Framerate); err != nil {
+        return err
+    }
+    peak := stackPeak(waveStack)
+    if strings.EqualFold(opts.Mode, "spectrogram") {
+        //every audio frame is one column, the frame shows the newest ones
+        full := drawSpectrogram(waveStack, peak, numFrames, opts)
+        for frame := 0; frame < numFrames; frame++ {
+            img := image.NewNRGBA(image.Rectangle{Max: opts.Size})
+            draw.Draw(img, img.Rect, image.NewUniform(opts.Gradient.At(0)), image.Point{}, draw.Src)
+            window := image.Rect(frame+1-opts.Size.X, 0, frame+1, opts.Size.Y).Intersect(full.Rect)
+            dst := image.Rect(opts.Size.X-window.Dx(), 0, opts.Size.X, opts.Size.Y)
+            draw.Draw(img, dst, full, window.Min, draw.Src)
+            if err := emit(frame, img); err != nil {
+                return err
+            }
+        }
+        return nil
+    }
+    for frame := 0; frame < numFrames; frame++ {
+        if err := emit(frame, drawBars(waveStack[frame], peak, opts)); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// Spectrogram draws the whole .wav stream as one image, time running from
+// left to right across opts.Size.X and low frequencies at the bottom.
+func Spectrogram(wav io.Reader, opts VisualOptions) (*image.NRGBA, error) {
+    if err := opts.Validate(); err != nil {
+        return nil, err
+    }
+    waveStack, numFrames, err := wave.WaveStackFromReader(wav, opts.Framerate, opts.Buckets)
+    if err != nil {
+        return nil, err
+    }
+    if err := checkFrames(numFrames, opts.Framerate); err != nil {
+        return nil, err
+    }
+    return drawSpectrogram(waveStack, stackPeak(waveStack), opts.Size.X, opts), nil
+}
+
+func checkFrames(numFrames, framerate int) error {
+    if numFrames == 0 {
+        return fmt.Errorf("audio is too short for a single frame at %d fps", framerate)
+    }
+    return nil
+}
+
+func stackPeak(waveStack [][]int) int {
+    peak := 1
+    for _, buckets := range waveStack {
+        for _, amplitude := range buckets {
+            if amplitude > peak {
+                peak = amplitude
+            }
+        }
+    }
+    return peak
+}
+
+// bucketAt is the bucket shown at pos of length pixels along the frequency
+// axis.
+func bucketAt(pos, length, buckets int, scale string) int {
+    t := float64(pos) / float64(length)
+    bucket := int(t * float64(buckets))
+    if strings.EqualFold(scale, "log") {
+        bucket = int(math.Pow(float64(buckets+1), t)) - 1
+    }
+    if bucket >= buckets {
+        bucket = buckets - 1
+    }
+    return bucket
+}
+
+// drawBars draws one bar per column, as high as the bucket under it and
+// coloured by height.
+func drawBars(buckets []int, peak int, opts VisualOptions) *image.NRGBA {
+    w, h := opts.Size.X, opts.Size.Y
+    img := image.NewNRGBA(image.Rect(0, 0, w, h))
+    draw.Draw(img, img.Rect, image.NewUniform(opts.Gradient.At(0)), image.Point{}, draw.Src)
+    for x := 0; x < w; x++ {
+        amplitude := buckets[bucketAt(x, w, len(buckets), opts.Scale)]
+        height := int(float64(amplitude) / float64(peak) * float64(h))
+        for y := 0; y < height; y++ {
+            img.SetNRGBA(x, h-1-y, opts.Gradient.At(float64(y+1)/float64(h)))
+        }
+    }
+    return img
+}
+
+// drawScope draws the samples of one frame as a connected line around the
+// middle, brighter where it swings further.
+func drawScope(samples []float64, opts VisualOptions) *image.NRGBA {
+    w, h := opts.Size.X, opts.Size.Y
+    img := image.NewNRGBA(image.Rect(0, 0, w, h))
+    draw.Draw(img, img.Rect, image.NewUniform(opts.Gradient.At(0)), image.Point{}, draw.Src)
+    if len(samples) == 0 {
+        return img
+    }
+    rowOf := func(v float64) int {
+        row := int((1 - v) / 2 * float64(h-1))
+        if row < 0 {
+            return 0
+        }
+        if row > h-1 {
+            return h - 1
+        }
+        return row
+    }
+    last := rowOf(samples[0])
+    for x := 0; x < w; x++ {
+        v := samples[x*len(samples)/w]
+        row := rowOf(v)
+        top, bottom := last, row
+        if top > bottom {
+            top, bottom = bottom, top
+        }
+        c := opts.Gradient.At(0.5 + math.Abs(v)/2)
+        for y := top; y <= bottom; y++ {
+            img.SetNRGBA(x, y, c)
+        }
+        last = row
+    }
+    return img
+}
+
+// spectrogramRange is how many decades below the peak the spectrogram
+// gradient reaches, 60 dB.
+const spectrogramRange = 3.0
+
+// drawSpectrogram draws the stack width columns wide, stretching or
+// squeezing time to fit. Amplitudes are on a log scale so that quiet bands
+// still show.
+func drawSpectrogram(waveStack [][]int, peak, width int, opts VisualOptions) *image.NRGBA {
+    h := opts.Size.Y
+    img := image.NewNRGBA(image.Rect(0, 0, width, h))
+    for x := 0; x < width; x++ {
+        buckets := waveStack[x*len(waveStack)/width]
+        for y := 0; y < h; y++ {
+            amplitude := float64(buckets[bucketAt(y, h, len(buckets), opts.Scale)])
+            if amplitude < 1 {
+                amplitude = 1
+            }
+            img.SetNRGBA(x, h-1-y, opts.Gradient.At(1+math.Log10(amplitude/float64(peak))/spectrogramRange))
+        }
+    }
+    return img
+}
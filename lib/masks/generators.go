@@ -0,0 +1,79 @@
+package masks
+
+import (
+    "fmt"
+    "image"
+    "image/color"
+    "image/draw"
+
+    f "github.com/faceplate-kleo/pixelsorter/lib/flags"
+    "github.com/faceplate-kleo/pixelsorter/lib/registry"
+)
+
+func init() {
+    registry.Masks.Register(registry.Entry[registry.MaskFunc]{
+        Name: "contrast",
+        Help: "pixels whose red channel reaches the threshold",
+        Params: []registry.Param{
+            {Name: "threshold", Kind: registry.Int, Default: "110", Help: "red channel threshold, 0-255"},
+            {Name: "invert", Kind: registry.Bool, Default: "false", Help: "sort the dark pixels instead"},
+        },
+        New: func(args registry.Args) (registry.MaskFunc, error) {
+            threshold := args.Int("threshold")
+            if threshold < 0 || threshold > 255 {
+                return nil, fmt.Errorf("threshold %d out of range 0-255", threshold)
+            }
+            flags := f.Flags{INVERT: args.Bool("invert")}
+            return func(img image.Image) *image.NRGBA {
+                return CreateContrastMask(img, uint8(threshold), flags)
+            }, nil
+        },
+    })
+    registry.Masks.Register(registry.Entry[registry.MaskFunc]{
+        Name: "luminance",
+        Help: "pixels whose brightness lies between low and high",
+        Params: []registry.Param{
+            {Name: "low", Kind: registry.Int, Default: "64", Help: "lowest brightness sorted, 0-255"},
+            {Name: "high", Kind: registry.Int, Default: "192", Help: "highest brightness sorted, 0-255"},
+        },
+        New: func(args registry.Args) (registry.MaskFunc, error) {
+            low, high := args.Int("low"), args.Int("high")
+            if low > high {
+                return nil, fmt.Errorf("low %d is above high %d", low, high)
+            }
+            return func(img image.Image) *image.NRGBA {
+                return LuminanceMask(img, low, high)
+            }, nil
+        },
+    })
+    registry.Masks.Register(registry.Entry[registry.MaskFunc]{
+        Name: "all",
+        Help: "every pixel, so spans run the full width of the image",
+        New: func(registry.Args) (registry.MaskFunc, error) {
+            return func(img image.Image) *image.NRGBA {
+                mask := image.NewNRGBA(img.Bounds())
+                draw.Draw(mask, mask.Rect, image.White, image.Point{}, draw.Src)
+                return mask
+            }, nil
+        },
+    })
+}
+
+// LuminanceMask marks the pixels whose perceived brightness, on a 0-255 scale,
+// lies within [low, high].
+func LuminanceMask(imData image.Image, low, high int) *image.NRGBA {
+    bounds := imData.Bounds()
+    mask := image.NewNRGBA(bounds)
+    for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+        for x := bounds.Min.X; x < bounds.Max.X; x++ {
+            r, g, b, _ := imData.At(x, y).RGBA()
+            lum := int((0.2126*float64(r) + 0.7152*float64(g) + 0.0722*float64(b)) / 257)
+            outColor := color.Black
+            if lum >= low && lum <= high {
+                outColor = color.White
+            }
+            mask.Set(x, y, outColor)
+        }
+    }
+    return mask
+}
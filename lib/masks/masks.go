@@ -2,12 +2,12 @@ package masks
 
 import (
 
+    pserrors "github.com/faceplate-kleo/pixelsorter/lib/errors"
     f "github.com/faceplate-kleo/pixelsorter/lib/flags"
-    psmath "github.com/faceplate-kleo/pixelsorter/lib/math"
 
     "image"
     "image/color"
-    "log"
+    "io"
     "os"
 )
 
@@ -20,7 +20,8 @@ func CreateContrastMask(imData image.Image, threshold uint8, flags f.Flags) *ima
 
 	for i := 0; i < max_x; i++ {
 		for j := 0; j < max_y; j++ {
-			currentColor := imData.At(i, j)
+			x, y := bounds.Min.X+i, bounds.Min.Y+j
+			currentColor := imData.At(x, y)
 			//comparator := calculate_luminance(currentColor)
 			comp_u32, _, _, _ := currentColor.RGBA()
 			comparator := uint8(comp_u32)
@@ -40,46 +41,55 @@ func CreateContrastMask(imData image.Image, threshold uint8, flags f.Flags) *ima
 				outColor = color.White
 			}
 
-			mask.Set(i, j, outColor)
+			mask.Set(x, y, outColor)
 		}
 	}
 
 	return mask
 }
 
-func ReadContrastMask(maskInPath string, bounds image.Rectangle) *image.NRGBA {
-	output := image.NewNRGBA(bounds)
-
+// ReadContrastMask reads a mask file. The mask must be exactly the size of
+// bounds.
+func ReadContrastMask(maskInPath string, bounds image.Rectangle) (*image.NRGBA, error) {
 	//open and read file
 	maskFile, err := os.Open(maskInPath)
 	if err != nil {
-		log.Fatal(err)
+		return nil, pserrors.IO("open", maskInPath, err)
 	}
 	defer maskFile.Close()
 
-	//truncate mask
-	maskData, _, err := image.Decode(maskFile)
-	if err != nil {
-		log.Fatal(err)
+	mask, err := DecodeContrastMask(maskFile, bounds)
+	if formatErr, ok := err.(*pserrors.FormatError); ok {
+		formatErr.Path = maskInPath
 	}
+	return mask, err
+}
 
-	bound_x := bounds.Dx()
-	bound_y := bounds.Dy()
-	mask_x := maskData.Bounds().Dx()
-	mask_y := maskData.Bounds().Dy()
+func DecodeContrastMask(r io.Reader, bounds image.Rectangle) (*image.NRGBA, error) {
+	maskData, _, err := image.Decode(r)
+	if err != nil {
+		return nil, &pserrors.FormatError{Err: err}
+	}
+	return MaskFromImage(maskData, bounds)
+}
 
-	final_x := psmath.IntMin(bound_x, mask_x)
-	final_y := psmath.IntMin(bound_y, mask_y)
+// MaskFromImage copies an in-memory mask into a buffer with the given bounds.
+// The mask must be exactly the size of bounds, but may have a different origin.
+func MaskFromImage(maskData image.Image, bounds image.Rectangle) (*image.NRGBA, error) {
+	if maskData.Bounds().Dx() != bounds.Dx() || maskData.Bounds().Dy() != bounds.Dy() {
+		return nil, &pserrors.MaskSizeError{Mask: maskData.Bounds(), Image: bounds}
+	}
 
 	//copy to output buffer
-
-	for i := 0; i < final_x; i++ {
-		for j := 0; j < final_y; j++ {
-			output.Set(i, j, maskData.At(i, j))
+	output := image.NewNRGBA(bounds)
+	mask_min := maskData.Bounds().Min
+	for i := 0; i < bounds.Dx(); i++ {
+		for j := 0; j < bounds.Dy(); j++ {
+			output.Set(bounds.Min.X+i, bounds.Min.Y+j, maskData.At(mask_min.X+i, mask_min.Y+j))
 		}
 	}
 
-	return output
+	return output, nil
 }
 
 func ColorIsWhite(toComp color.Color) bool {
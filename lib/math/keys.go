@@ -0,0 +1,93 @@
+package math
+
+import (
+    "image/color"
+
+    "github.com/faceplate-kleo/pixelsorter/lib/registry"
+)
+
+func init() {
+    plain := func(name, help string, key registry.KeyFunc) {
+        registry.Keys.Register(registry.Entry[registry.KeyFunc]{
+            Name: name,
+            Help: help,
+            New: func(registry.Args) (registry.KeyFunc, error) {
+                return key, nil
+            },
+        })
+    }
+    plain("mean", "average of the red, green and blue channels", func(c color.Color) float64 {
+        return float64(MeanKey(c))
+    })
+    plain("red", "red channel", func(c color.Color) float64 {
+        return float64(RedKey(c))
+    })
+    plain("green", "green channel", func(c color.Color) float64 {
+        _, g, _, _ := c.RGBA()
+        return float64(g)
+    })
+    plain("blue", "blue channel", func(c color.Color) float64 {
+        _, _, b, _ := c.RGBA()
+        return float64(b)
+    })
+    plain("luminance", "perceived brightness (Rec. 709 weights)", LuminanceKey)
+    plain("hue", "hue angle in degrees", HueKey)
+    plain("saturation", "HSV saturation", SaturationKey)
+}
+
+func LuminanceKey(c color.Color) float64 {
+    r, g, b, _ := c.RGBA()
+    return 0.2126*float64(r) + 0.7152*float64(g) + 0.0722*float64(b)
+}
+
+func HueKey(c color.Color) float64 {
+    r, g, b, _ := c.RGBA()
+    fr, fg, fb := float64(r), float64(g), float64(b)
+    high := max3(fr, fg, fb)
+    chroma := high - min3(fr, fg, fb)
+    if chroma == 0 {
+        return 0
+    }
+    var hue float64
+    switch high {
+    case fr:
+        hue = (fg - fb) / chroma
+        if hue < 0 {
+            hue += 6
+        }
+    case fg:
+        hue = (fb - fr)/chroma + 2
+    default:
+        hue = (fr - fg)/chroma + 4
+    }
+    return hue * 60
+}
+
+func SaturationKey(c color.Color) float64 {
+    r, g, b, _ := c.RGBA()
+    high := max3(float64(r), float64(g), float64(b))
+    if high == 0 {
+        return 0
+    }
+    return (high - min3(float64(r), float64(g), float64(b))) / high
+}
+
+func max3(a, b, c float64) float64 {
+    if b > a {
+        a = b
+    }
+    if c > a {
+        a = c
+    }
+    return a
+}
+
+func min3(a, b, c float64) float64 {
+    if b < a {
+        a = b
+    }
+    if c < a {
+        a = c
+    }
+    return a
+}
@@ -19,6 +19,28 @@ func MeanCompare(colorA, colorB color.Color, flags f.Flags) bool {
     }
 }
 
+func MeanKey(c color.Color) uint32 {
+    r, g, b, _ := c.RGBA()
+    return (r + g + b) / 3
+}
+
+func RedKey(c color.Color) uint32 {
+    r, _, _, _ := c.RGBA()
+    return r
+}
+
+// ColorKey returns the sort key of a color according to the comparison flags,
+// matching the order used by Merge.
+func ColorKey(c color.Color, flags f.Flags) float64 {
+    if flags.KEY != nil {
+        return flags.KEY(c)
+    }
+    if flags.GRAY_RED_COMPARE {
+        return float64(RedKey(c))
+    }
+    return float64(MeanKey(c))
+}
+
 func RedCompare(colorA, colorB color.Color, flags f.Flags) bool {
     ar, _, _, _ := colorA.RGBA()
     br, _, _, _ := colorB.RGBA()
@@ -35,7 +57,14 @@ func Merge(a []color.Color, iLeft, iRight, iEnd int, b []color.Color, flags f.Fl
 
     for k := iLeft; k < iEnd; k++ {
         comp := false 
-        if i < len(a) && j < len(a) {
+        if i < len(a) && j < len(a) && flags.KEY != nil {
+            key_a, key_b := flags.KEY(a[i]), flags.KEY(a[j])
+            if flags.DESCEND {
+                comp = key_a > key_b
+            } else {
+                comp = key_a < key_b
+            }
+        } else if i < len(a) && j < len(a) {
             if flags.MEAN_COMPARE {
                 comp = MeanCompare(a[i], a[j], flags)
             }
@@ -98,6 +127,26 @@ func SpanMergesort(span []color.Color, flags f.Flags) []color.Color {
 
 }
 
+// PeakOrder lays out an already sorted span so that it rises to the middle
+// and falls after it.
+func PeakOrder(sorted []color.Color) []color.Color {
+    n := len(sorted)
+    peaked := make([]color.Color, n)
+    left, right := 0, n-1
+    for k := 0; k < n; k++ {
+        if k % 2 == 0 {
+            peaked[left] = sorted[k]
+            left++
+        } else {
+            peaked[right] = sorted[k]
+            right--
+        }
+    }
+    return peaked
+}
+
+// GetRandomColor uses the global generator and can not be reproduced. Prefer
+// RandomColor with a seeded Rand.
 func GetRandomColor() color.RGBA {
     ra := uint8(rand.Intn(255))
     rg := uint8(rand.Intn(255))
@@ -0,0 +1,58 @@
+package math
+
+import (
+    "image/color"
+    "time"
+)
+
+// Rand is a small splitmix64 generator. It is cheap enough to create one per
+// frame, row or span, each seeded from the render seed with SubSeed, which
+// keeps output identical no matter how work is spread across goroutines.
+type Rand struct {
+    state uint64
+}
+
+func NewRand(seed int64) Rand {
+    return Rand{state: uint64(seed)}
+}
+
+func (r *Rand) Uint64() uint64 {
+    r.state += 0x9e3779b97f4a7c15
+    z := r.state
+    z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+    z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+    return z ^ (z >> 31)
+}
+
+// Intn returns a number in [0, n). Like math/rand it panics if n <= 0.
+func (r *Rand) Intn(n int) int {
+    if n <= 0 {
+        panic("invalid argument to Intn")
+    }
+    return int(r.Uint64() % uint64(n))
+}
+
+// SubSeed derives the seed of the index-th child of seed.
+func SubSeed(seed, index int64) int64 {
+    r := NewRand(seed ^ (index * -0x2e4ab5cd2e6d12fd))
+    r.Uint64()
+    return int64(r.Uint64())
+}
+
+// RandomSeed picks a fresh non-zero seed for renders that did not ask for one.
+func RandomSeed() int64 {
+    r := NewRand(time.Now().UnixNano())
+    for {
+        if seed := int64(r.Uint64() >> 1); seed != 0 {
+            return seed
+        }
+    }
+}
+
+func RandomColor(rng *Rand) color.RGBA {
+    ra := uint8(rng.Intn(255))
+    rg := uint8(rng.Intn(255))
+    rb := uint8(rng.Intn(255))
+
+    return color.RGBA{ra, rg, rb, 255}
+}
@@ -1,30 +1,70 @@
 package nrgbautil
 
 import (
+    "fmt"
     "image"
     "image/draw"
+    "image/gif"
+    "image/jpeg"
     "image/png"
-    "fmt"
-    "log"
+    "io"
     "os"
+    "strings"
 
+    pserrors "github.com/faceplate-kleo/pixelsorter/lib/errors"
     f "github.com/faceplate-kleo/pixelsorter/lib/flags"
     psmath "github.com/faceplate-kleo/pixelsorter/lib/math"
 )
 
-func LoadImage(path string) *image.NRGBA {
-    
+// Formats lists the output formats Encode understands.
+var Formats = []string{"png", "jpeg", "gif"}
+
+// KnownFormat reports whether format is one of Formats, jpg for jpeg, or
+// empty for png.
+func KnownFormat(format string) bool {
+    if strings.EqualFold(format, "jpg") {
+        return true
+    }
+    for _, known := range Formats {
+        if strings.EqualFold(known, format) {
+            return true
+        }
+    }
+    return format == ""
+}
+
+// LoadImage decodes the image at path. A path of "-" reads standard input.
+func LoadImage(path string) (*image.NRGBA, error) {
+    if path == "-" {
+        return DecodeImage(os.Stdin)
+    }
     imgFile, err := os.Open(path)
     if err != nil {
-        log.Fatal(err)
+        return nil, pserrors.IO("open", path, err)
     }
     defer imgFile.Close()
 
-    imData, _, err := image.Decode(imgFile)
+    imData, err := DecodeImage(imgFile)
     if err != nil {
-        fmt.Println(err)
+        if formatErr, ok := err.(*pserrors.FormatError); ok {
+            formatErr.Path = path
+        }
+        return nil, err
     }
+    return imData, nil
+}
 
+// DecodeImage decodes any registered image format from r into an NRGBA.
+func DecodeImage(r io.Reader) (*image.NRGBA, error) {
+    imData, _, err := image.Decode(r)
+    if err != nil {
+        return nil, &pserrors.FormatError{Err: err}
+    }
+    return ToNrgba(imData), nil
+}
+
+// ToNrgba returns img as an NRGBA, converting it only if it is not one already.
+func ToNrgba(imData image.Image) *image.NRGBA {
     if _, ok := imData.(*image.NRGBA); ok {
         return imData.(*image.NRGBA)
     } else {
@@ -34,26 +74,76 @@ func LoadImage(path string) *image.NRGBA {
     }
 }
 
-func WriteFile (imData *image.NRGBA, path string) {
+func WriteFile (imData *image.NRGBA, path string) error {
+    return WriteFileFormat(imData, path, "png")
+}
+
+// WriteFileFormat writes imData to path in one of Formats. A path of "-"
+// writes standard output.
+func WriteFileFormat(imData *image.NRGBA, path, format string) error {
+    if path == "-" {
+        return Encode(os.Stdout, imData, format)
+    }
     out, err := os.Create(path)
     if err != nil {
-        log.Fatal(err)
+        return pserrors.IO("create", path, err)
     }
-    png.Encode(out, imData.SubImage(imData.Rect))
-    out.Close()
+    if err := Encode(out, imData, format); err != nil {
+        out.Close()
+        return err
+    }
+    return pserrors.IO("close", path, out.Close())
+}
+
+// Encode writes imData to w in one of Formats. An empty format means png,
+// and jpg is taken for jpeg.
+func Encode(w io.Writer, imData image.Image, format string) error {
+    switch strings.ToLower(format) {
+    case "", "png":
+        return EncodePNG(w, imData)
+    case "jpeg", "jpg":
+        if err := jpeg.Encode(w, imData, &jpeg.Options{Quality: 95}); err != nil {
+            return pserrors.IO("encode jpeg", "", err)
+        }
+        return nil
+    case "gif":
+        if err := gif.Encode(w, imData, nil); err != nil {
+            return pserrors.IO("encode gif", "", err)
+        }
+        return nil
+    }
+    return fmt.Errorf("%w: image format %q, expected one of %s",
+        pserrors.ErrUnsupportedFormat, format, strings.Join(Formats, ", "))
+}
+
+func EncodePNG(w io.Writer, imData image.Image) error {
+    if err := png.Encode(w, imData); err != nil {
+        return pserrors.IO("encode png", "", err)
+    }
+    return nil
 }
 
+// DataToNrgba is DataToNrgbaSeeded with a random seed.
 func DataToNrgba(imData image.Image, flags f.Flags) *image.NRGBA{
-    out := image.NewNRGBA(imData.Bounds())
-    max_x := imData.Bounds().Dx()
-    max_y := imData.Bounds().Dy()
+    return DataToNrgbaSeeded(imData, flags, psmath.RandomSeed())
+}
+
+// DataToNrgbaSeeded copies imData into a new NRGBA. With SOURCE_DEBUG set the
+// image is replaced by noise generated from seed.
+func DataToNrgbaSeeded(imData image.Image, flags f.Flags, seed int64) *image.NRGBA{
+    bounds := imData.Bounds()
+    out := image.NewNRGBA(bounds)
+    rng := psmath.NewRand(seed)
+    max_x := bounds.Dx()
+    max_y := bounds.Dy()
 
     for i := 0; i < max_x; i++ {
         for j := 0; j < max_y; j++ {
+            x, y := bounds.Min.X + i, bounds.Min.Y + j
             if flags.SOURCE_DEBUG {
-                out.Set(i, j, psmath.GetRandomColor())
+                out.Set(x, y, psmath.RandomColor(&rng))
             } else {
-                out.Set(i, j, imData.At(i, j)) 
+                out.Set(x, y, imData.At(x, y)) 
             }
         }
     }
@@ -61,105 +151,142 @@ func DataToNrgba(imData image.Image, flags f.Flags) *image.NRGBA{
     return out
 }
 
+// Reorigin returns a view of imData that shares its pixels but has its top
+// left corner at origin.
+func Reorigin(imData *image.NRGBA, origin image.Point) *image.NRGBA {
+    return &image.NRGBA{
+        Pix: imData.Pix,
+        Stride: imData.Stride,
+        Rect: imData.Rect.Sub(imData.Rect.Min).Add(origin),
+    }
+}
+
+// ReverseRowsNrgba mirrors every row in place.
 func ReverseRowsNrgba(imData *image.NRGBA) {
-    for i := 0; i < imData.Rect.Dy(); i++ {
-        a := 0 
-        b := imData.Rect.Dx()
+    rect := imData.Rect
+    for y := rect.Min.Y; y < rect.Max.Y; y++ {
+        a := rect.Min.X
+        b := rect.Max.X - 1
 
         for a < b {
-            tmp := imData.At(a, i)
-            imData.Set(a, i, imData.At(b, i))
-            imData.Set(b, i, tmp)
+            tmp := imData.NRGBAAt(a, y)
+            imData.SetNRGBA(a, y, imData.NRGBAAt(b, y))
+            imData.SetNRGBA(b, y, tmp)
             a++
             b--
         }
     }
 }
+
+// ReverseColsNrgba mirrors every column in place.
 func ReverseColsNrgba(imData *image.NRGBA) {
-    for i := 0; i < imData.Rect.Dx(); i++ {
-        a := 0 
-        b := imData.Rect.Dy()
+    rect := imData.Rect
+    for x := rect.Min.X; x < rect.Max.X; x++ {
+        a := rect.Min.Y
+        b := rect.Max.Y - 1
 
         for a < b {
-            tmp := imData.At(a, i)
-            imData.Set(i, a, imData.At(b, i))
-            imData.Set(i, b, tmp)
+            tmp := imData.NRGBAAt(x, a)
+            imData.SetNRGBA(x, a, imData.NRGBAAt(x, b))
+            imData.SetNRGBA(x, b, tmp)
             a++
             b--
         }
     }
 }
 
+// RotateNrgba rotates imData by a number of quarter turns: 1 turns it
+// clockwise and 3 counter-clockwise. Odd turns swap the X and Y of the
+// bounds, so that rotating back restores them. imData is not modified.
 func RotateNrgba(imData *image.NRGBA, rotations int) *image.NRGBA {
-    init_x := imData.Bounds().Dx()
-    init_y := imData.Bounds().Dy()
-
-    desired_x := init_x
-    desired_y := init_y
+    rotations = ((rotations % 4) + 4) % 4
+    rect := imData.Rect
+    in_w := rect.Dx()
+    in_h := rect.Dy()
 
+    out_rect := rect
     if rotations % 2 != 0 {
-        desired_x = init_y 
-        desired_y = init_x
-    }
-
-    output := image.NewNRGBA(image.Rect(0, 0, desired_x, desired_y))
-
-    if rotations == 2 {
-
-        for i := 0; i < desired_y; i++ {
-            for j := 0; j < desired_x; j++ {
-                output.Set(j, i, imData.At(j,i))
-            }
-        }
-        ReverseRowsNrgba(output)
-        ReverseColsNrgba(output)
-        return output
-    }
-
-    if rotations == 3 {
-        ReverseRowsNrgba(imData)
+        out_rect = image.Rect(rect.Min.Y, rect.Min.X, rect.Max.Y, rect.Max.X)
     }
+    output := image.NewNRGBA(out_rect)
 
-    if rotations % 2 != 0 {
-        for i := 0; i < desired_y; i++ {
-            for j := 0; j < desired_x; j++ {
-                output.Set(j, i, imData.At(i,j))
+    for j := 0; j < out_rect.Dy(); j++ {
+        for i := 0; i < out_rect.Dx(); i++ {
+            //source pixel, relative to the top left of imData
+            src_x, src_y := i, j
+            switch rotations {
+            case 1:
+                src_x, src_y = j, in_h-1-i
+            case 2:
+                src_x, src_y = in_w-1-i, in_h-1-j
+            case 3:
+                src_x, src_y = in_w-1-j, i
             }
+            output.SetNRGBA(out_rect.Min.X + i, out_rect.Min.Y + j, imData.NRGBAAt(rect.Min.X + src_x, rect.Min.Y + src_y))
         }
     }
 
-    if rotations == 1 {
-        ReverseRowsNrgba(output)
-    }
-
-
-    if rotations == 3 {
-        ReverseRowsNrgba(imData)
-    }
-
     return output 
 }
 
+// FlipNrgba returns a mirrored copy of imData, left to right when horizontal
+// is set and top to bottom otherwise.
 func FlipNrgba(imData *image.NRGBA, horizontal bool) *image.NRGBA {
     output := image.NewNRGBA(imData.Bounds())
-    bound := imData.Bounds().Dy()
-    altbound := imData.Bounds().Dx()
-
-    if !horizontal {
-        bound = imData.Bounds().Dx()
-        altbound = imData.Bounds().Dy()
-    }
-
-    for i := 0; i < bound; i++ {
-        for j := 0; j < altbound; j++ {
-            output.Set(j, i, imData.At(j, i))        
-        }
-    }
+    draw.Draw(output, output.Rect, imData, imData.Rect.Min, draw.Src)
 
     if horizontal {
         ReverseRowsNrgba(output)
+    } else {
+        ReverseColsNrgba(output)
     }
 
     return output 
 }
 
+// Downscale shrinks imData by averaging boxes of pixels so that neither side
+// is longer than maxSide, keeping the aspect ratio. Smaller images, and a
+// maxSide of zero or less, are returned as they are.
+func Downscale(imData *image.NRGBA, maxSide int) *image.NRGBA {
+    bounds := imData.Bounds()
+    w, h := bounds.Dx(), bounds.Dy()
+    if maxSide <= 0 || (w <= maxSide && h <= maxSide) {
+        return imData
+    }
+    ow, oh := maxSide, maxSide
+    if w > h {
+        oh = h * maxSide / w
+    } else {
+        ow = w * maxSide / h
+    }
+    if ow < 1 {
+        ow = 1
+    }
+    if oh < 1 {
+        oh = 1
+    }
+
+    out := image.NewNRGBA(image.Rect(0, 0, ow, oh))
+    for oy := 0; oy < oh; oy++ {
+        y0, y1 := oy*h/oh, (oy+1)*h/oh
+        for ox := 0; ox < ow; ox++ {
+            x0, x1 := ox*w/ow, (ox+1)*w/ow
+            var sum [4]int
+            for y := y0; y < y1; y++ {
+                row := imData.PixOffset(bounds.Min.X+x0, bounds.Min.Y+y)
+                for x := x0; x < x1; x++ {
+                    for c := 0; c < 4; c++ {
+                        sum[c] += int(imData.Pix[row+c])
+                    }
+                    row += 4
+                }
+            }
+            n := (y1 - y0) * (x1 - x0)
+            i := out.PixOffset(ox, oy)
+            for c := 0; c < 4; c++ {
+                out.Pix[i+c] = uint8(sum[c] / n)
+            }
+        }
+    }
+    return out
+}
@@ -0,0 +1,207 @@
+// Package preview draws images straight into a terminal, with the kitty
+// graphics protocol, sixel, or coloured half-block characters.
+package preview
+
+import (
+    "bufio"
+    "bytes"
+    "encoding/base64"
+    "fmt"
+    "image"
+    "image/color"
+    "io"
+    "os"
+    "strings"
+
+    pserrors "github.com/faceplate-kleo/pixelsorter/lib/errors"
+    "github.com/faceplate-kleo/pixelsorter/lib/nrgbautil"
+)
+
+// Protocols lists the ways Write can draw, best first.
+var Protocols = []string{"kitty", "sixel", "blocks"}
+
+// cellWidth is the assumed width of a terminal cell in pixels, used to size
+// kitty and sixel images to a number of columns.
+const cellWidth = 8
+
+// Detect picks the protocol the terminal advertises through its environment,
+// which survives ssh through TERM. Terminals without kitty or sixel support
+// get half-blocks, which need 24-bit colour.
+func Detect() string {
+    term := strings.ToLower(os.Getenv("TERM"))
+    program := strings.ToLower(os.Getenv("TERM_PROGRAM"))
+    switch {
+    case os.Getenv("KITTY_WINDOW_ID") != "", term == "xterm-kitty", term == "xterm-ghostty",
+        program == "wezterm", program == "ghostty":
+        return "kitty"
+    case strings.Contains(term, "sixel"), strings.HasPrefix(term, "foot"), term == "mlterm",
+        program == "mlterm", program == "iterm.app":
+        return "sixel"
+    }
+    return "blocks"
+}
+
+// Write draws img at most columns terminal cells wide, and as tall as the
+// same number of cells at twice the height, downscaling it to fit. An empty
+// protocol means Detect.
+func Write(w io.Writer, img image.Image, protocol string, columns int) error {
+    if protocol == "" {
+        protocol = Detect()
+    }
+    if columns < 1 {
+        return fmt.Errorf("%w: preview needs at least one column, got %d", pserrors.ErrInvalidOptions, columns)
+    }
+    imData := flatten(nrgbautil.ToNrgba(img))
+    out := bufio.NewWriter(w)
+    var err error
+    switch strings.ToLower(protocol) {
+    case "kitty":
+        err = writeKitty(out, nrgbautil.Downscale(imData, columns*cellWidth))
+    case "sixel":
+        writeSixel(out, nrgbautil.Downscale(imData, columns*cellWidth))
+    case "blocks":
+        writeBlocks(out, nrgbautil.Downscale(imData, columns))
+    default:
+        return fmt.Errorf("%w: preview protocol %q, expected one of %s",
+            pserrors.ErrUnsupportedFormat, protocol, strings.Join(Protocols, ", "))
+    }
+    if err != nil {
+        return err
+    }
+    if err := out.Flush(); err != nil {
+        return pserrors.IO("write", "preview", err)
+    }
+    return nil
+}
+
+// flatten composites img over black, as terminals have no transparency to
+// speak of.
+func flatten(img *image.NRGBA) *image.NRGBA {
+    out := image.NewNRGBA(image.Rectangle{Max: img.Bounds().Size()})
+    for y := 0; y < out.Rect.Dy(); y++ {
+        for x := 0; x < out.Rect.Dx(); x++ {
+            c := img.NRGBAAt(img.Rect.Min.X+x, img.Rect.Min.Y+y)
+            a := uint16(c.A)
+            out.SetNRGBA(x, y, color.NRGBA{uint8(uint16(c.R) * a / 255), uint8(uint16(c.G) * a / 255), uint8(uint16(c.B) * a / 255), 255})
+        }
+    }
+    return out
+}
+
+// writeKitty sends the image as a PNG in chunks of at most 4096 base64 bytes,
+// as the kitty protocol asks.
+func writeKitty(w *bufio.Writer, img *image.NRGBA) error {
+    var encoded bytes.Buffer
+    if err := nrgbautil.EncodePNG(&encoded, img); err != nil {
+        return err
+    }
+    payload := base64.StdEncoding.EncodeToString(encoded.Bytes())
+    for first := true; ; first = false {
+        chunk := payload
+        if len(chunk) > 4096 {
+            chunk = chunk[:4096]
+        }
+        payload = payload[len(chunk):]
+        more := 0
+        if payload != "" {
+            more = 1
+        }
+        if first {
+            fmt.Fprintf(w, "\x1b_Ga=T,f=100,m=%d;%s\x1b\\", more, chunk)
+        } else {
+            fmt.Fprintf(w, "\x1b_Gm=%d;%s\x1b\\", more, chunk)
+        }
+        if payload == "" {
+            break
+        }
+    }
+    fmt.Fprintln(w)
+    return nil
+}
+
+// writeSixel draws the image with a 6x6x6 colour cube. Every band of six rows
+// is drawn once per colour used in it.
+func writeSixel(w *bufio.Writer, img *image.NRGBA) {
+    width, height := img.Rect.Dx(), img.Rect.Dy()
+    fmt.Fprintf(w, "\x1bPq\"1;1;%d;%d", width, height)
+    for i := 0; i < 216; i++ {
+        fmt.Fprintf(w, "#%d;2;%d;%d;%d", i, i/36*20, i/6%6*20, i%6*20)
+    }
+
+    index := make([]int, width*height)
+    for y := 0; y < height; y++ {
+        for x := 0; x < width; x++ {
+            c := img.NRGBAAt(x, y)
+            index[y*width+x] = cubeLevel(c.R)*36 + cubeLevel(c.G)*6 + cubeLevel(c.B)
+        }
+    }
+    bits := make([]byte, width)
+    for band := 0; band < height; band += 6 {
+        used := [216]bool{}
+        for y := band; y < band+6 && y < height; y++ {
+            for x := 0; x < width; x++ {
+                used[index[y*width+x]] = true
+            }
+        }
+        first := true
+        for colour := 0; colour < 216; colour++ {
+            if !used[colour] {
+                continue
+            }
+            for x := range bits {
+                bits[x] = 0
+                for row := 0; row < 6 && band+row < height; row++ {
+                    if index[(band+row)*width+x] == colour {
+                        bits[x] |= 1 << row
+                    }
+                }
+            }
+            if !first {
+                w.WriteByte('$')
+            }
+            first = false
+            fmt.Fprintf(w, "#%d", colour)
+            writeSixelRow(w, bits)
+        }
+        w.WriteByte('-')
+    }
+    w.WriteString("\x1b\\\n")
+}
+
+// writeSixelRow writes one colour of a band, run-length encoded.
+func writeSixelRow(w *bufio.Writer, bits []byte) {
+    for x := 0; x < len(bits); {
+        run := 1
+        for x+run < len(bits) && bits[x+run] == bits[x] {
+            run++
+        }
+        if run > 3 {
+            fmt.Fprintf(w, "!%d%c", run, 63+bits[x])
+        } else {
+            for i := 0; i < run; i++ {
+                w.WriteByte(63 + bits[x])
+            }
+        }
+        x += run
+    }
+}
+
+func cubeLevel(v uint8) int {
+    return (int(v)*5 + 127) / 255
+}
+
+// writeBlocks draws two pixels per cell with the upper half block, the top
+// pixel as foreground and the bottom one as background.
+func writeBlocks(w *bufio.Writer, img *image.NRGBA) {
+    width, height := img.Rect.Dx(), img.Rect.Dy()
+    for y := 0; y < height; y += 2 {
+        for x := 0; x < width; x++ {
+            top, bottom := img.NRGBAAt(x, y), color.NRGBA{0, 0, 0, 255}
+            if y+1 < height {
+                bottom = img.NRGBAAt(x, y+1)
+            }
+            fmt.Fprintf(w, "\x1b[38;2;%d;%d;%dm\x1b[48;2;%d;%d;%dm▀", top.R, top.G, top.B, bottom.R, bottom.G, bottom.B)
+        }
+        w.WriteString("\x1b[0m\n")
+    }
+}
@@ -0,0 +1,267 @@
+package registry
+
+import (
+    "fmt"
+    "image"
+    "image/color"
+    "io"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+)
+
+// KeyFunc is the value pixels are sorted by.
+type KeyFunc func(c color.Color) float64
+
+// MaskFunc builds a mask for an image. White pixels are sorted, everything
+// else is left alone. The mask must have the bounds of img.
+type MaskFunc func(img image.Image) *image.NRGBA
+
+// SpanFunc rewrites the pixels of one span in place. sort sorts a slice by the
+// active key and order, and rand returns a number in [0, n) from the seeded
+// generator of the span.
+type SpanFunc func(span []color.Color, sort func([]color.Color), rand func(n int) int)
+
+// IntervalFunc places a span on a mask run. The run covers [runStart, runEnd)
+// and the span that the scalar, noise and signal ask for is [spanStart,
+// spanEnd). The result must stay within [0, domain).
+type IntervalFunc func(runStart, runEnd, spanStart, spanEnd, domain int) (int, int)
+
+// The registries the sorter draws on. Packages register their entries from
+// init, so importing a package is enough to make its effects available.
+var (
+    Keys = New[KeyFunc]("key")
+    Masks = New[MaskFunc]("mask")
+    SpanOps = New[SpanFunc]("span op")
+    Intervals = New[IntervalFunc]("interval")
+)
+
+type ParamKind int
+
+const (
+    Int ParamKind = iota
+    Float
+    Bool
+    String
+)
+
+func (k ParamKind) String() string {
+    switch k {
+    case Int:
+        return "int"
+    case Float:
+        return "float"
+    case Bool:
+        return "bool"
+    }
+    return "string"
+}
+
+// Param describes one parameter of an entry. Default is written the way a
+// user would type it.
+type Param struct {
+    Name string
+    Kind ParamKind
+    Default string
+    Help string
+}
+
+// Args holds the parameter values of one entry, already checked against the
+// declared kinds. Getters return the zero value for undeclared names.
+type Args struct {
+    values map[string]any
+}
+
+func (a Args) Int(name string) int {
+    v, _ := a.values[name].(int)
+    return v
+}
+
+func (a Args) Float(name string) float64 {
+    v, _ := a.values[name].(float64)
+    return v
+}
+
+func (a Args) Bool(name string) bool {
+    v, _ := a.values[name].(bool)
+    return v
+}
+
+func (a Args) String(name string) string {
+    v, _ := a.values[name].(string)
+    return v
+}
+
+// Bind parses values for the declared params, falling back to their defaults.
+// Values for names that are not declared are ignored, so one set of values can
+// be shared between several entries.
+func Bind(params []Param, values map[string]string) (Args, error) {
+    args := Args{values: make(map[string]any, len(params))}
+    for _, param := range params {
+        raw, ok := values[param.Name]
+        if !ok {
+            raw = param.Default
+        }
+        var v any
+        var err error
+        switch param.Kind {
+        case Int:
+            v, err = strconv.Atoi(raw)
+        case Float:
+            v, err = strconv.ParseFloat(raw, 64)
+        case Bool:
+            v, err = strconv.ParseBool(raw)
+        default:
+            v = raw
+        }
+        if err != nil {
+            return Args{}, fmt.Errorf("param %s: %q is not a valid %s", param.Name, raw, param.Kind)
+        }
+        args.values[param.Name] = v
+    }
+    return args, nil
+}
+
+// Entry is one named effect. New builds it from its parameters.
+type Entry[T any] struct {
+    Name string
+    Help string
+    Params []Param
+    New func(args Args) (T, error)
+}
+
+// Registry is a set of entries of one kind, looked up by case-insensitive
+// name. It is safe for concurrent use.
+type Registry[T any] struct {
+    kind string
+    mu sync.RWMutex
+    entries map[string]Entry[T]
+}
+
+func New[T any](kind string) *Registry[T] {
+    return &Registry[T]{kind: kind, entries: map[string]Entry[T]{}}
+}
+
+func (r *Registry[T]) Kind() string {
+    return r.kind
+}
+
+// Register adds an entry. Like image.RegisterFormat it is meant to be called
+// from init, and it panics on an empty or duplicate name.
+func (r *Registry[T]) Register(entry Entry[T]) {
+    name := strings.ToLower(entry.Name)
+    if name == "" || entry.New == nil {
+        panic("registry: " + r.kind + " entry needs a name and a constructor")
+    }
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    if _, dup := r.entries[name]; dup {
+        panic("registry: " + r.kind + " " + name + " registered twice")
+    }
+    entry.Name = name
+    r.entries[name] = entry
+}
+
+func (r *Registry[T]) Lookup(name string) (Entry[T], bool) {
+    r.mu.RLock()
+    defer r.mu.RUnlock()
+    entry, ok := r.entries[strings.ToLower(name)]
+    return entry, ok
+}
+
+func (r *Registry[T]) Has(name string) bool {
+    _, ok := r.Lookup(name)
+    return ok
+}
+
+// Names lists the registered names in order.
+func (r *Registry[T]) Names() []string {
+    r.mu.RLock()
+    defer r.mu.RUnlock()
+    names := make([]string, 0, len(r.entries))
+    for name := range r.entries {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    return names
+}
+
+func (r *Registry[T]) Entries() []Entry[T] {
+    names := r.Names()
+    entries := make([]Entry[T], len(names))
+    for i, name := range names {
+        entries[i], _ = r.Lookup(name)
+    }
+    return entries
+}
+
+// New builds the named entry with the given parameter values.
+func (r *Registry[T]) New(name string, values map[string]string) (T, error) {
+    var zero T
+    entry, ok := r.Lookup(name)
+    if !ok {
+        return zero, r.UnknownError(name)
+    }
+    args, err := Bind(entry.Params, values)
+    if err != nil {
+        return zero, fmt.Errorf("%s %s: %w", r.kind, entry.Name, err)
+    }
+    built, err := entry.New(args)
+    if err != nil {
+        return zero, fmt.Errorf("%s %s: %w", r.kind, entry.Name, err)
+    }
+    return built, nil
+}
+
+func (r *Registry[T]) UnknownError(name string) error {
+    return fmt.Errorf("unknown %s %q, expected one of %s", r.kind, name, strings.Join(r.Names(), ", "))
+}
+
+// Describe writes every entry with its parameters, for help output.
+func (r *Registry[T]) Describe(w io.Writer) {
+    for _, entry := range r.Entries() {
+        fmt.Fprintf(w, "    %-14s %s\n", entry.Name, entry.Help)
+        for _, param := range entry.Params {
+            fmt.Fprintf(w, "        %s=%s (%s) %s\n", param.Name, param.Default, param.Kind, param.Help)
+        }
+    }
+}
+
+// DeclaresParam reports whether any registered entry has a param called name.
+func DeclaresParam(name string) bool {
+    name = strings.ToLower(name)
+    for _, params := range [][][]Param{Keys.params(), Masks.params(), SpanOps.params(), Intervals.params()} {
+        for _, list := range params {
+            for _, param := range list {
+                if param.Name == name {
+                    return true
+                }
+            }
+        }
+    }
+    return false
+}
+
+func (r *Registry[T]) params() [][]Param {
+    r.mu.RLock()
+    defer r.mu.RUnlock()
+    params := make([][]Param, 0, len(r.entries))
+    for _, entry := range r.entries {
+        params = append(params, entry.Params)
+    }
+    return params
+}
+
+// DescribeAll writes every registry, for help output.
+func DescribeAll(w io.Writer) {
+    fmt.Fprintln(w, "Sort keys (-key):")
+    Keys.Describe(w)
+    fmt.Fprintln(w, "Mask generators (-mask_gen):")
+    Masks.Describe(w)
+    fmt.Fprintln(w, "Span ops (-span_op):")
+    SpanOps.Describe(w)
+    fmt.Fprintln(w, "Intervals (-anchor):")
+    Intervals.Describe(w)
+    fmt.Fprintln(w, "Parameters are set with -param name=value.")
+}
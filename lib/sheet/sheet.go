@@ -0,0 +1,117 @@
+// Package sheet lays out images in a labelled grid, a contact sheet.
+package sheet
+
+import (
+    "image"
+    "image/color"
+    "image/draw"
+    "strings"
+)
+
+var (
+    Background = color.NRGBA{24, 24, 24, 255}
+    Foreground = color.NRGBA{230, 230, 230, 255}
+)
+
+// Cell is one image of a sheet with the label printed under it.
+type Cell struct {
+    Image image.Image
+    Label string
+}
+
+// Layout is where Compose put each cell image, in the order of the cells.
+type Layout struct {
+    Columns int
+    Rows int
+    Cells []image.Rectangle
+}
+
+// Compose draws the cells row by row, columns to a row. Every cell gets the
+// size of the largest image, and labels are wrapped at spaces to fit the cell
+// width. scale enlarges the label font, as far as the longest word fits.
+func Compose(cells []Cell, columns, scale int) (*image.NRGBA, Layout) {
+    if columns < 1 {
+        columns = 1
+    }
+    if scale < 1 {
+        scale = 1
+    }
+    rows := (len(cells) + columns - 1) / columns
+    layout := Layout{Columns: columns, Rows: rows, Cells: make([]image.Rectangle, len(cells))}
+
+    cellSize := image.Point{}
+    for _, cell := range cells {
+        size := cell.Image.Bounds().Size()
+        if size.X > cellSize.X {
+            cellSize.X = size.X
+        }
+        if size.Y > cellSize.Y {
+            cellSize.Y = size.Y
+        }
+    }
+    for scale > 1 && !wordsFit(cells, cellSize.X, scale) {
+        scale--
+    }
+    labels := make([][]string, len(cells))
+    labelLines := 0
+    for i, cell := range cells {
+        labels[i] = wrap(cell.Label, cellSize.X, scale)
+        if len(labels[i]) > labelLines {
+            labelLines = len(labels[i])
+        }
+    }
+
+    padding := 4 * scale
+    labelHeight := labelLines * LineHeight(scale)
+    pitch := image.Pt(cellSize.X+padding, cellSize.Y+labelHeight+2*padding)
+    out := image.NewNRGBA(image.Rect(0, 0, columns*pitch.X+padding, rows*pitch.Y+padding))
+    draw.Draw(out, out.Rect, image.NewUniform(Background), image.Point{}, draw.Src)
+
+    for i, cell := range cells {
+        origin := image.Pt(padding+(i%columns)*pitch.X, padding+(i/columns)*pitch.Y)
+        bounds := cell.Image.Bounds()
+        rect := image.Rectangle{Min: origin, Max: origin.Add(bounds.Size())}
+        draw.Draw(out, rect, cell.Image, bounds.Min, draw.Src)
+        layout.Cells[i] = rect
+
+        labelArea := image.Rect(origin.X, origin.Y+cellSize.Y+padding, origin.X+cellSize.X, origin.Y+cellSize.Y+padding+labelHeight)
+        clip := out.SubImage(labelArea).(*image.NRGBA)
+        for line, text := range labels[i] {
+            DrawText(clip, labelArea.Min.X, labelArea.Min.Y+line*LineHeight(scale), text, Foreground, scale)
+        }
+    }
+    return out, layout
+}
+
+// wrap breaks a label into lines no wider than width. A single word that is
+// too long gets a line of its own and is cut off when drawn.
+func wrap(label string, width, scale int) []string {
+    lines := []string{}
+    line := ""
+    for _, word := range strings.Fields(label) {
+        candidate := word
+        if line != "" {
+            candidate = line + " " + word
+        }
+        if line != "" && TextWidth(candidate, scale) > width {
+            lines = append(lines, line)
+            candidate = word
+        }
+        line = candidate
+    }
+    if line != "" {
+        lines = append(lines, line)
+    }
+    return lines
+}
+
+func wordsFit(cells []Cell, width, scale int) bool {
+    for _, cell := range cells {
+        for _, word := range strings.Fields(cell.Label) {
+            if TextWidth(word, scale) > width {
+                return false
+            }
+        }
+    }
+    return true
+}
@@ -3,69 +3,77 @@ package wave
 import (
 	"encoding/binary"
 	"fmt"
-	"log"
+	"io"
 	"math"
 	"os"
 	"sort"
 
+	pserrors "github.com/faceplate-kleo/pixelsorter/lib/errors"
 	"github.com/mjibson/go-dsp/fft"
 )
 
-func ReadWav(filepath string, frame_rate int) ([][][]byte, int) {
+func ReadWav(filepath string, frame_rate int) ([][][]byte, int, error) {
 	wavfile, err := os.Open(filepath)
 	if err != nil {
-		log.Fatal(err)
+		return nil, 0, pserrors.IO("open", filepath, err)
 	}
 	defer wavfile.Close()
 
-	header_buf := make([]byte, 44)
+	h, frames, err := DecodeWav(wavfile, frame_rate)
+	return frames, h.SampleRate, err
+}
 
-	n, err := wavfile.Read(header_buf)
+// MinFrameSamples is the fewest samples a frame can have for its frequency
+// buckets to be worked out.
+const MinFrameSamples = 4
 
-	if n != 44 {
-		log.Fatal("Fatal: .wav read failure")
+// DecodeWav reads a PCM .wav stream and splits its samples into frames of
+// 1/frame_rate seconds, of at least MinFrameSamples samples. It also returns
+// the header of the stream.
+func DecodeWav(r io.Reader, frame_rate int) (Header, [][][]byte, error) {
+	raw, err := io.ReadAll(r)
+	if err != nil {
+		return Header{}, nil, pserrors.IO("read", "", err)
 	}
+	if len(raw) < 44 {
+		return Header{}, nil, &pserrors.WavHeaderError{Field: "header", Reason: fmt.Sprintf("file is only %d bytes long", len(raw))}
+	}
+	header_buf := raw[0:44]
 
 	//byte info from https://docs.fileformat.com/audio/wav/
 
-	fmt.Println("Reading WAV...")
-	mark := string(header_buf[0:5])                            // RIFF File marker
-	fsiz := int(binary.LittleEndian.Uint32(header_buf[4:8]))   // Filesize - 8 bytes
-	ftyp := string(header_buf[8:12])                           // File type header (just "WAVE")
-	chnk := string(header_buf[12:16])                          // Format chunk marker (just "fmt ", space intentional)
-	flen := int(binary.LittleEndian.Uint32(header_buf[16:20])) // Format data length
-	pcmf := int(binary.LittleEndian.Uint16(header_buf[20:22])) // Type of format (1 = PCM)
-	chnl := int(binary.LittleEndian.Uint16(header_buf[22:24])) // Number of channels
-	rate := int(binary.LittleEndian.Uint32(header_buf[24:28])) // Sample rate (Hertz)
-	nrte := int(binary.LittleEndian.Uint32(header_buf[28:32])) // (SampleRate * BitsPerSample * Channels) / 8
-	widt := int(binary.LittleEndian.Uint16(header_buf[32:34])) // (BitsPerSample * Channels)/8
-	btps := int(binary.LittleEndian.Uint16(header_buf[34:36])) // Bits per sample
-	dhed := string(header_buf[36:40])                          // Data chunk header (just "data")
-	dsiz := int(binary.LittleEndian.Uint32(header_buf[40:44])) // Size of the data section
-
-	fmt.Println(mark, fsiz, ftyp, chnk, flen, pcmf, chnl, rate, nrte, widt, btps, dhed, dsiz)
-
-	data := make([]byte, fsiz)
-	n, err = wavfile.ReadAt(data, 43)
-
-	num_samples := (dsiz / widt)
-
-	bytes_per_sample := btps / 8
+	fsiz := int(binary.LittleEndian.Uint32(header_buf[4:8])) // Filesize - 8 bytes
+	h, err := parseHeader(header_buf)
+	if err != nil {
+		return h, nil, err
+	}
+	if frame_rate <= 0 || h.SampleRate/frame_rate < MinFrameSamples {
+		return h, nil, fmt.Errorf("%w: frame rate %d leaves fewer than %d samples per frame of %d Hz audio",
+			pserrors.ErrInvalidOptions, frame_rate, MinFrameSamples, h.SampleRate)
+	}
+
+	n := len(raw) - 43
+	if fsiz < n {
+		n = fsiz
+	}
+	data := raw[43 : 43+n]
+
+	num_samples := h.DataSize / h.BlockAlign
+
+	bytes_per_sample := h.BitsPerSample / 8
+	if num_samples*bytes_per_sample*h.Channels > n {
+		return h, nil, &pserrors.WavHeaderError{Field: "data size", Reason: fmt.Sprintf("header claims %d bytes of data but the file holds %d", h.DataSize, n)}
+	}
 	samples := make([][]byte, num_samples)
 
 	ptr := 0
 	for i := 0; i < num_samples; i++ {
 
-		samples[i] = data[ptr : ptr+(bytes_per_sample*chnl)]
-		ptr += bytes_per_sample * chnl
+		samples[i] = data[ptr : ptr+(bytes_per_sample*h.Channels)]
+		ptr += bytes_per_sample * h.Channels
 	}
-	playtime := float32(num_samples) / float32(rate)
-	fmt.Println("PLAYTIME: ", playtime)
-
-	samples_per_frame := rate / frame_rate
-	num_frames := int(playtime * float32(frame_rate))
-	fmt.Println(num_samples, "samples at", bytes_per_sample, "bytes per sample")
-	fmt.Println(num_frames, "frames at", samples_per_frame, "samples per frame")
+	samples_per_frame := h.SampleRate / frame_rate
+	num_frames := h.Frames(frame_rate)
 
 	frame_samples := make([][][]byte, num_frames)
 	ptr = 0
@@ -74,7 +82,73 @@ func ReadWav(filepath string, frame_rate int) ([][][]byte, int) {
 		ptr += samples_per_frame
 	}
 
-	return frame_samples, rate
+	return h, frame_samples, nil
+}
+
+// Header is what the 44 byte header of a PCM .wav stream says about it.
+type Header struct {
+	Channels      int
+	SampleRate    int
+	BitsPerSample int
+	BlockAlign    int
+	DataSize      int
+}
+
+// DecodeHeader reads and checks only the header of a .wav stream, which is
+// enough to know its length without reading the samples.
+func DecodeHeader(r io.Reader) (Header, error) {
+	header_buf := make([]byte, 44)
+	if n, err := io.ReadFull(r, header_buf); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return Header{}, &pserrors.WavHeaderError{Field: "header", Reason: fmt.Sprintf("file is only %d bytes long", n)}
+		}
+		return Header{}, pserrors.IO("read", "", err)
+	}
+	return parseHeader(header_buf)
+}
+
+// parseHeader reads the fields of a 44 byte header and checks them.
+func parseHeader(header_buf []byte) (Header, error) {
+	h := Header{
+		Channels:      int(binary.LittleEndian.Uint16(header_buf[22:24])),
+		SampleRate:    int(binary.LittleEndian.Uint32(header_buf[24:28])),
+		BlockAlign:    int(binary.LittleEndian.Uint16(header_buf[32:34])),
+		BitsPerSample: int(binary.LittleEndian.Uint16(header_buf[34:36])),
+		DataSize:      int(binary.LittleEndian.Uint32(header_buf[40:44])),
+	}
+	err := checkWavHeader(string(header_buf[0:5]), string(header_buf[8:12]), int(binary.LittleEndian.Uint16(header_buf[20:22])),
+		h.Channels, h.SampleRate, h.BlockAlign, h.BitsPerSample)
+	return h, err
+}
+
+// Playtime is the length of the audio in seconds.
+func (h Header) Playtime() float32 {
+	return float32(h.DataSize/h.BlockAlign) / float32(h.SampleRate)
+}
+
+// Frames is the number of frames DecodeWav splits the audio into.
+func (h Header) Frames(frame_rate int) int {
+	return int(h.Playtime() * float32(frame_rate))
+}
+
+func checkWavHeader(mark, ftyp string, pcmf, chnl, rate, widt, btps int) error {
+	switch {
+	case mark[0:4] != "RIFF":
+		return &pserrors.WavHeaderError{Field: "marker", Reason: fmt.Sprintf("expected RIFF, got %q", mark[0:4])}
+	case ftyp != "WAVE":
+		return &pserrors.WavHeaderError{Field: "file type", Reason: fmt.Sprintf("expected WAVE, got %q", ftyp)}
+	case pcmf != 1:
+		return &pserrors.WavHeaderError{Field: "format", Reason: fmt.Sprintf("only PCM (1) is supported, got %d", pcmf)}
+	case chnl < 1:
+		return &pserrors.WavHeaderError{Field: "channels", Reason: "no channels"}
+	case rate < 1:
+		return &pserrors.WavHeaderError{Field: "sample rate", Reason: fmt.Sprintf("invalid rate %d", rate)}
+	case btps < 8 || btps%8 != 0:
+		return &pserrors.WavHeaderError{Field: "bits per sample", Reason: fmt.Sprintf("unsupported width %d", btps)}
+	case widt < 1:
+		return &pserrors.WavHeaderError{Field: "block align", Reason: fmt.Sprintf("invalid block align %d", widt)}
+	}
+	return nil
 }
 
 func SampleWav(wavData [][][]byte, index, channel int) []byte {
@@ -124,7 +198,14 @@ func BucketsFromSample(sample []byte, num_buckets, sample_rate int) []int {
 			ind = len(reals)
 		}
 		slice_end := ind + bucket_width
+		if slice_end > len(reals) {
+			slice_end = len(reals)
+		}
 		data_slice := reals[ind:slice_end]
+		if len(data_slice) == 0 {
+			//more buckets than frequency bins at this frame size
+			continue
+		}
 		//mean or max?
 
 		//max:
@@ -138,8 +219,24 @@ func BucketsFromSample(sample []byte, num_buckets, sample_rate int) []int {
 
 }
 
-func CreateWaveStack(waveIn string, framerate, num_buckets int) ([][]int, int) {
-    wavData, sampleRate := ReadWav(waveIn, framerate)
+func CreateWaveStack(waveIn string, framerate, num_buckets int) ([][]int, int, error) {
+    wavfile, err := os.Open(waveIn)
+    if err != nil {
+        return nil, 0, pserrors.IO("open", waveIn, err)
+    }
+    defer wavfile.Close()
+
+    return WaveStackFromReader(wavfile, framerate, num_buckets)
+}
+
+// WaveStackFromReader reads a .wav stream and returns the frequency buckets of
+// every frame, along with the number of frames.
+func WaveStackFromReader(r io.Reader, framerate, num_buckets int) ([][]int, int, error) {
+    h, wavData, err := DecodeWav(r, framerate)
+    if err != nil {
+        return nil, 0, err
+    }
+    sampleRate := h.SampleRate
     output := make([][]int, len(wavData))
 
     all_buckets := make([][]int, len(wavData))
@@ -157,6 +254,35 @@ func CreateWaveStack(waveIn string, framerate, num_buckets int) ([][]int, int) {
         }
     }
 
-    return output, len(wavData)
+    return output, len(wavData), nil
 }
 
+
+// WaveformFromReader reads a .wav stream and returns the samples of the first
+// channel of every frame, scaled to -1..1, along with the number of frames.
+// Frames are cut the same way as for WaveStackFromReader.
+func WaveformFromReader(r io.Reader, framerate int) ([][]float64, int, error) {
+    h, wavData, err := DecodeWav(r, framerate)
+    if err != nil {
+        return nil, 0, err
+    }
+    width := h.BitsPerSample / 8
+
+    output := make([][]float64, len(wavData))
+    for frame, samples := range wavData {
+        output[frame] = make([]float64, len(samples))
+        for i, sample := range samples {
+            output[frame][i] = sampleValue(sample[:width])
+        }
+    }
+    return output, len(wavData), nil
+}
+
+// sampleValue scales one little-endian PCM sample to -1..1. 8 bit samples are
+// unsigned, wider ones signed, and only their top 16 bits are used.
+func sampleValue(sample []byte) float64 {
+    if len(sample) == 1 {
+        return (float64(sample[0]) - 128) / 128
+    }
+    return float64(int16(binary.LittleEndian.Uint16(sample[len(sample)-2:]))) / 32768
+}
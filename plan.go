@@ -0,0 +1,326 @@
+package main
+
+import (
+    "bufio"
+    "fmt"
+    "image"
+    "io"
+    "math/bits"
+    "os"
+    "runtime"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/faceplate-kleo/pixelsorter/lib/anim"
+    pserrors "github.com/faceplate-kleo/pixelsorter/lib/errors"
+    psmath "github.com/faceplate-kleo/pixelsorter/lib/math"
+    "github.com/faceplate-kleo/pixelsorter/lib/nrgbautil"
+    "github.com/faceplate-kleo/pixelsorter/lib/wave"
+    "github.com/faceplate-kleo/pixelsorter/src/core"
+)
+
+// histogramWidth is the length of the longest bar of a span histogram.
+const histogramWidth = 30
+
+// registerDryRun adds -dry-run, which reports on a render instead of
+// running it.
+func (c *renderCmd) registerDryRun() {
+    c.fs.BoolVar(&c.dryRun, "dry-run", false, "Report mask coverage, spans, audio length and the estimated time and memory of the render on standard output, without rendering. A -dump-recipe or -save-preset is still written")
+}
+
+// renderPlan is what a dry run found out about a render.
+type renderPlan struct {
+    input image.Point
+    passes []core.PassStats
+    // frames is 0 for a still image.
+    frames int
+    // sample is the sorted sample frame, sampleFrame its index in the audio.
+    sample *image.NRGBA
+    sampleFrame int
+    // output is the time it took to write the sample frame.
+    output time.Duration
+    workers int
+    gif bool
+    audio *wave.Header
+    audioFramerate, audioBuckets int
+    available uint64
+}
+
+// planRender sorts the input of a recipe once, all passes for a still image
+// and the first one as a sample frame of an animation, and writes the plan
+// to standard output. Nothing is written to the outputs of the recipe.
+func planRender(recipe *core.Recipe) error {
+    imData, passes, err := loadRecipe(recipe)
+    if err != nil {
+        return err
+    }
+    plan := &renderPlan{input: imData.Bounds().Size(), workers: 1, available: memAvailable()}
+    if animation := recipe.Animation; animation != nil {
+        //animations render the first pass only
+        passes = passes[:1]
+        plan.frames = animation.Frames
+        plan.gif = strings.EqualFold(animation.Format, "gif")
+        if audio := animation.Audio; audio != nil {
+            header, err := readWavHeader(audio.Wav)
+            if err != nil {
+                return err
+            }
+            plan.audio = &header
+            plan.audioFramerate, plan.audioBuckets = audio.Framerate, audio.Buckets
+            plan.frames = header.Frames(audio.Framerate)
+            plan.workers = runtime.GOMAXPROCS(0)
+            if plan.frames < plan.workers {
+                plan.workers = psmath.IntMax(plan.frames, 1)
+            }
+            if err := plan.sampleWave(imData, audio, passes[0].Options); err != nil {
+                return err
+            }
+        }
+    }
+    if plan.passes == nil {
+        if plan.passes, plan.sample, err = core.PlanPasses(imData, passes); err != nil {
+            return err
+        }
+    }
+    if plan.frames > 0 {
+        if plan.output, err = timeOutput(plan.sample, plan.gif); err != nil {
+            return err
+        }
+    }
+
+    out := bufio.NewWriter(os.Stdout)
+    plan.write(out, recipe)
+    if err := out.Flush(); err != nil {
+        return pserrors.IO("write", "plan", err)
+    }
+    return nil
+}
+
+// sampleWave renders a frame of the audio as the sample, as the audio signal
+// is what decides how long its spans are.
+func (p *renderPlan) sampleWave(imData image.Image, audio *core.RecipeAudio, opts core.Options) error {
+    wavfile, err := os.Open(audio.Wav)
+    if err != nil {
+        return pserrors.IO("open", audio.Wav, err)
+    }
+    defer wavfile.Close()
+    stats, sample, frame, err := core.PlanWaveFrame(imData, wavfile, opts, audio.Framerate, audio.Buckets)
+    if err != nil {
+        return err
+    }
+    p.passes, p.sample, p.sampleFrame = []core.PassStats{stats}, sample, frame
+    return nil
+}
+
+// timeOutput measures writing one frame: turning it into a paletted frame
+// and encoding it for a gif, or encoding a png for frames.
+func timeOutput(frame *image.NRGBA, gif bool) (time.Duration, error) {
+    began := time.Now()
+    if !gif {
+        err := nrgbautil.EncodePNG(io.Discard, frame)
+        return time.Since(began), err
+    }
+    sink := anim.NewGifSink(io.Discard, nil)
+    if err := sink.WriteFrame(0, frame, 0); err != nil {
+        return 0, err
+    }
+    err := sink.Close()
+    return time.Since(began), err
+}
+
+func readWavHeader(path string) (wave.Header, error) {
+    wavfile, err := os.Open(path)
+    if err != nil {
+        return wave.Header{}, pserrors.IO("open", path, err)
+    }
+    defer wavfile.Close()
+    return wave.DecodeHeader(wavfile)
+}
+
+func (p *renderPlan) write(w io.Writer, recipe *core.Recipe) {
+    pixels := p.input.X * p.input.Y
+    fmt.Fprintf(w, "input     %s, %dx%d (%.1f megapixels)\n", recipe.Input, p.input.X, p.input.Y, float64(pixels)/1e6)
+    if p.audio != nil {
+        h := p.audio
+        playtime := time.Duration(float64(h.Playtime()) * float64(time.Second))
+        fmt.Fprintf(w, "audio     %s, %s, %d Hz, %d channels, %d bit\n",
+            recipe.Animation.Audio.Wav, playtime.Round(time.Millisecond), h.SampleRate, h.Channels, h.BitsPerSample)
+        fmt.Fprintf(w, "frames    %d at %d fps\n", p.frames, p.audioFramerate)
+    } else if p.frames > 0 {
+        fmt.Fprintf(w, "frames    %d\n", p.frames)
+    }
+
+    var elapsed time.Duration
+    for i, pass := range p.passes {
+        elapsed += pass.Elapsed
+        label := fmt.Sprintf("pass %d", i+1)
+        if p.frames > 0 {
+            label = "sample"
+        }
+        if p.audio != nil {
+            fmt.Fprintf(w, "%-9s frame %d, of median loudness\n", label, p.sampleFrame)
+            label = ""
+        }
+        coverage := "no mask, whole lines are reordered"
+        if pass.Masked {
+            coverage = fmt.Sprintf("mask covers %.1f%% of %d pixels", 100*float64(pass.MaskPixels)/float64(psmath.IntMax(pass.Pixels, 1)), pass.Pixels)
+        }
+        fmt.Fprintf(w, "%-9s %s, %s, sorted in %s\n", label, pass.Mode, coverage, pass.Elapsed.Round(time.Millisecond))
+        writeSpans(w, pass.Spans)
+    }
+
+    if p.frames == 0 {
+        fmt.Fprintf(w, "time      %s, measured\n", elapsed.Round(time.Millisecond))
+    } else {
+        format := "png"
+        if p.gif {
+            format = "gif"
+        }
+        rounds := (p.frames + p.workers - 1) / p.workers
+        fmt.Fprintf(w, "time      ~%s, %s sorting and %s writing %s per frame on %d worker(s)\n",
+            ((elapsed + p.output) * time.Duration(rounds)).Round(time.Second),
+            elapsed.Round(time.Millisecond), p.output.Round(time.Millisecond), format, p.workers)
+    }
+    p.writeMemory(w)
+}
+
+// writeSpans prints the span count and a histogram of span lengths in powers
+// of two.
+func writeSpans(w io.Writer, spans []int) {
+    if spans == nil {
+        return
+    }
+    if len(spans) == 0 {
+        fmt.Fprintln(w, "          no spans")
+        return
+    }
+    sorted := append([]int(nil), spans...)
+    sort.Ints(sorted)
+    total := 0
+    for _, n := range sorted {
+        total += n
+    }
+    fmt.Fprintf(w, "          %d spans, length min %d, median %d, mean %.1f, max %d\n",
+        len(sorted), sorted[0], sorted[len(sorted)/2], float64(total)/float64(len(sorted)), sorted[len(sorted)-1])
+
+    counts := make([]int, bits.Len(uint(sorted[len(sorted)-1]))+1)
+    peak := 0
+    for _, n := range sorted {
+        bucket := bits.Len(uint(n))
+        counts[bucket]++
+        if counts[bucket] > peak {
+            peak = counts[bucket]
+        }
+    }
+    for bucket := bits.Len(uint(sorted[0])); bucket < len(counts); bucket++ {
+        count := counts[bucket]
+        low, high := 0, 0
+        if bucket > 0 {
+            low, high = 1<<(bucket-1), 1<<bucket-1
+        }
+        lengths := strconv.Itoa(low)
+        if high > low {
+            lengths += "-" + strconv.Itoa(high)
+        }
+        bar := strings.Repeat("#", (count*histogramWidth+peak-1)/peak)
+        fmt.Fprintf(w, "          %11s %-*s %d\n", lengths, histogramWidth, bar, count)
+    }
+}
+
+// writeMemory estimates the peak memory of the render: the input, the
+// frames being sorted at once, GIF frames kept until the file is written
+// and the decoded audio. The allocations of a frame are those measured for
+// the sample, which makes an upper bound of what one sort holds at a time.
+func (p *renderPlan) writeMemory(w io.Writer) {
+    pixels := uint64(p.input.X * p.input.Y)
+    var allocated uint64
+    for _, pass := range p.passes {
+        allocated += pass.Allocated
+    }
+    type part struct {
+        name string
+        bytes uint64
+        note string
+    }
+    parts := []part{{"input", 4 * pixels, ""}}
+    if p.frames == 0 {
+        parts = append(parts, part{"sorting", allocated, "allocated over all passes"})
+    } else {
+        parts = append(parts, part{"sorting", uint64(p.workers) * allocated,
+            fmt.Sprintf("%d frame(s) at once, %s each", p.workers, formatBytes(allocated))})
+        if p.gif {
+            parts = append(parts, part{"gif", uint64(p.frames) * pixels,
+                fmt.Sprintf("%d paletted frames of %s, held until the gif is written", p.frames, formatBytes(pixels))})
+        }
+    }
+    if h := p.audio; h != nil {
+        //the file, a slice per sample and the buckets of every frame
+        samples := uint64(h.DataSize / h.BlockAlign)
+        parts = append(parts, part{"audio", uint64(h.DataSize) + 24*samples + uint64(p.frames*p.audioBuckets*8), "decoded .wav"})
+    }
+    //everything but the sorting stays live, and the collector lets the heap
+    //grow to twice what is live before it runs
+    var live uint64
+    for _, pt := range parts {
+        if pt.name != "sorting" {
+            live += pt.bytes
+        }
+    }
+    parts = append(parts, part{"gc", live, "room the garbage collector lets the heap grow by"})
+
+    var total uint64
+    for _, pt := range parts {
+        total += pt.bytes
+    }
+    fmt.Fprintf(w, "memory    ~%s peak\n", formatBytes(total))
+    for _, pt := range parts {
+        fmt.Fprintln(w, strings.TrimRight(fmt.Sprintf("          %-8s %10s  %s", pt.name, formatBytes(pt.bytes), pt.note), " "))
+    }
+    if p.available == 0 {
+        return
+    }
+    fmt.Fprintf(w, "available %s\n", formatBytes(p.available))
+    if total > p.available {
+        advice := "use fewer frames or a smaller input"
+        if p.gif {
+            advice = "use -format frames, which writes every frame as it finishes, or fewer frames or a smaller input"
+        }
+        fmt.Fprintf(w, "WARNING: the render needs more memory than is available, %s\n", advice)
+    }
+}
+
+// memAvailable is the memory the kernel reports as available, or 0 where it
+// can not be told.
+func memAvailable() uint64 {
+    meminfo, err := os.ReadFile("/proc/meminfo")
+    if err != nil {
+        return 0
+    }
+    for _, line := range strings.Split(string(meminfo), "\n") {
+        fields := strings.Fields(line)
+        if len(fields) >= 2 && fields[0] == "MemAvailable:" {
+            kb, err := strconv.ParseUint(fields[1], 10, 64)
+            if err != nil {
+                return 0
+            }
+            return kb * 1024
+        }
+    }
+    return 0
+}
+
+func formatBytes(n uint64) string {
+    units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+    value := float64(n)
+    unit := 0
+    for value >= 1024 && unit < len(units)-1 {
+        value /= 1024
+        unit++
+    }
+    if unit == 0 {
+        return fmt.Sprintf("%d B", n)
+    }
+    return fmt.Sprintf("%.1f %s", value, units[unit])
+}
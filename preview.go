@@ -0,0 +1,45 @@
+package main
+
+import (
+    "flag"
+    "fmt"
+    "image"
+    "os"
+    "strings"
+
+    "github.com/faceplate-kleo/pixelsorter/lib/preview"
+)
+
+// previewFlags show a downscaled result in the terminal. A nil or disabled
+// previewFlags shows nothing.
+type previewFlags struct {
+    enabled bool
+    protocol string
+    columns int
+}
+
+func (p *previewFlags) register(fs *flag.FlagSet) {
+    fs.BoolVar(&p.enabled, "preview", false, "Show a downscaled result in the terminal")
+    fs.StringVar(&p.protocol, "preview_protocol", "", "How to draw the preview: "+strings.Join(preview.Protocols, ", ")+" (default what the terminal advertises, else blocks)")
+    fs.IntVar(&p.columns, "preview_width", 80, "Width of the preview in terminal columns")
+}
+
+// show draws imData on standard output, or on stderr when standard output is
+// not a terminal, e.g. with -out -.
+func (p *previewFlags) show(imData image.Image) error {
+    if p == nil || !p.enabled {
+        return nil
+    }
+    for _, out := range []*os.File{os.Stdout, os.Stderr} {
+        if isTerminal(out) {
+            return preview.Write(out, imData, p.protocol, p.columns)
+        }
+    }
+    fmt.Fprintln(os.Stderr, "preview: no terminal to draw on")
+    return nil
+}
+
+func isTerminal(f *os.File) bool {
+    info, err := f.Stat()
+    return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+    "fmt"
+    "os"
+    "strings"
+    "time"
+
+    "github.com/faceplate-kleo/pixelsorter/src/core"
+)
+
+const progressWidth = 30
+
+// progressBar draws a single updating progress line on stderr. unit names
+// what is counted, e.g. frames.
+func progressBar(label, unit string) core.ProgressFunc {
+    return func(p core.Progress) {
+        if p.Total <= 0 {
+            return
+        }
+        filled := progressWidth * p.Done / p.Total
+        bar := strings.Repeat("#", filled) + strings.Repeat("-", progressWidth-filled)
+        fmt.Fprintf(os.Stderr, "\r%s [%s] %d/%d %s, %s elapsed, ~%s left ",
+            label, bar, p.Done, p.Total, unit,
+            p.Elapsed.Round(time.Second), p.Remaining().Round(time.Second))
+        if p.Done == p.Total {
+            fmt.Fprintln(os.Stderr)
+        }
+    }
+}
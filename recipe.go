@@ -0,0 +1,156 @@
+package main
+
+import (
+    "flag"
+    "os"
+
+    pserrors "github.com/faceplate-kleo/pixelsorter/lib/errors"
+    "github.com/faceplate-kleo/pixelsorter/src/core"
+)
+
+// recipeFlags copies the value of a top-level flag from the recipe the flags
+// describe onto a loaded recipe.
+var recipeFlags = map[string]func(dst, src *core.Recipe){
+    "in": func(dst, src *core.Recipe) { dst.Input = src.Input },
+    "seed": func(dst, src *core.Recipe) { dst.Seed = src.Seed },
+    "source_debug": func(dst, src *core.Recipe) { dst.SourceDebug = src.SourceDebug },
+    "mask_out": func(dst, src *core.Recipe) { dst.MaskOutput = src.MaskOutput },
+    //-format of the animating commands is the animation format
+    "format": func(dst, src *core.Recipe) {
+        if src.Animation == nil {
+            dst.Format = src.Format
+        }
+    },
+}
+
+// animationFlags does the same for the animation settings. -out names the
+// animation for the commands that animate.
+var animationFlags = map[string]func(dst, src *core.RecipeAnimation){
+    "out": func(dst, src *core.RecipeAnimation) { dst.Output = src.Output },
+    "frames": func(dst, src *core.RecipeAnimation) { dst.Frames = src.Frames },
+    "format": func(dst, src *core.RecipeAnimation) { dst.Format = src.Format },
+    "wav": func(dst, src *core.RecipeAnimation) {
+        if src.Audio == nil {
+            return
+        }
+        if dst.Audio == nil {
+            audio := *src.Audio
+            dst.Audio = &audio
+            return
+        }
+        dst.Audio.Wav = src.Audio.Wav
+    },
+    "framerate": func(dst, src *core.RecipeAnimation) {
+        if dst.Audio != nil && src.Audio != nil {
+            dst.Audio.Framerate = src.Audio.Framerate
+        }
+    },
+    "buckets": func(dst, src *core.RecipeAnimation) {
+        if dst.Audio != nil && src.Audio != nil {
+            dst.Audio.Buckets = src.Audio.Buckets
+        }
+    },
+}
+
+// passFlags copies a pass-level flag onto a pass of the loaded recipe.
+var passFlags = map[string]func(dst *core.RecipePass, src core.RecipePass){
+    "direction": func(dst *core.RecipePass, src core.RecipePass) { dst.Direction = src.Direction },
+    "descend": func(dst *core.RecipePass, src core.RecipePass) { dst.Descend = src.Descend },
+    "crush": func(dst *core.RecipePass, src core.RecipePass) { dst.Crush = src.Crush },
+    "key": func(dst *core.RecipePass, src core.RecipePass) { dst.Key = src.Key },
+    "mean_compare": func(dst *core.RecipePass, src core.RecipePass) { dst.Key = src.Key },
+    "red_compare": func(dst *core.RecipePass, src core.RecipePass) { dst.Key = src.Key },
+    "region": func(dst *core.RecipePass, src core.RecipePass) { dst.Region = src.Region },
+    "mask": func(dst *core.RecipePass, src core.RecipePass) { dst.Mask.Path = src.Mask.Path },
+    "mask_gen": func(dst *core.RecipePass, src core.RecipePass) { dst.Mask.Generator = src.Mask.Generator },
+    "threshold": func(dst *core.RecipePass, src core.RecipePass) { dst.Mask.Threshold = src.Mask.Threshold },
+    "invert": func(dst *core.RecipePass, src core.RecipePass) { dst.Mask.Invert = src.Mask.Invert },
+    "mask_debug": func(dst *core.RecipePass, src core.RecipePass) { dst.DebugMask = src.DebugMask },
+    "anchor": func(dst *core.RecipePass, src core.RecipePass) { dst.Interval.Anchor = src.Interval.Anchor },
+    "scalar": func(dst *core.RecipePass, src core.RecipePass) { dst.Interval.Scalar = src.Interval.Scalar },
+    "noise": func(dst *core.RecipePass, src core.RecipePass) { dst.Interval.Noise = src.Interval.Noise },
+    "clean": func(dst *core.RecipePass, src core.RecipePass) { dst.Interval.Clean = src.Interval.Clean },
+    "span_op": func(dst *core.RecipePass, src core.RecipePass) { dst.SpanOp = src.SpanOp },
+    "span_debug": func(dst *core.RecipePass, src core.RecipePass) { dst.DebugSpans = src.DebugSpans },
+    "mode": func(dst *core.RecipePass, src core.RecipePass) { dst.Mode = src.Mode },
+    "tile_op": func(dst *core.RecipePass, src core.RecipePass) { dst.TileOp = src.TileOp },
+    "tiles": func(dst *core.RecipePass, src core.RecipePass) { dst.Mode, dst.Tiles = src.Mode, src.Tiles },
+    "block": func(dst *core.RecipePass, src core.RecipePass) { dst.Mode, dst.Block = src.Mode, src.Block },
+    "aggregate": func(dst *core.RecipePass, src core.RecipePass) { dst.Aggregate = src.Aggregate },
+    "scan": func(dst *core.RecipePass, src core.RecipePass) { dst.Scan = src.Scan },
+    "param": func(dst *core.RecipePass, src core.RecipePass) {
+        params := map[string]string{}
+        for name, value := range dst.Params {
+            params[name] = value
+        }
+        for name, value := range src.Params {
+            params[name] = value
+        }
+        dst.Params = params
+    },
+}
+
+// overlayFlags applies every flag of fs that was given explicitly on top of
+// a loaded recipe. src is the recipe the flags describe on their own and base
+// the pass they describe. The command decides whether there is an animation:
+// src has one exactly when the command animates, and a loaded animation is
+// kept with the flags on top. -pass replaces the passes of the recipe.
+func overlayFlags(fs *flag.FlagSet, dst, src *core.Recipe, base core.RecipePass) {
+    set := map[string]bool{}
+    fs.Visit(func(fl *flag.Flag) {
+        set[fl.Name] = true
+    })
+
+    for name, apply := range recipeFlags {
+        if set[name] {
+            apply(dst, src)
+        }
+    }
+    switch {
+    case src.Animation == nil:
+        dst.Animation = nil
+        if set["out"] {
+            dst.Output = src.Output
+        }
+    case dst.Animation == nil:
+        dst.Animation = src.Animation
+    default:
+        for name, apply := range animationFlags {
+            if set[name] {
+                apply(dst.Animation, src.Animation)
+            }
+        }
+    }
+
+    if set["pass"] {
+        dst.Passes = src.Passes
+        return
+    }
+    for name, apply := range passFlags {
+        if !set[name] {
+            continue
+        }
+        for i := range dst.Passes {
+            apply(&dst.Passes[i], base)
+        }
+    }
+}
+
+// writeRecipe saves the recipe to path, or prints it for "-".
+func writeRecipe(recipe *core.Recipe, path string) error {
+    if path == "-" {
+        return recipe.Encode(os.Stdout)
+    }
+    file, err := os.Create(path)
+    if err != nil {
+        return pserrors.IO("create", path, err)
+    }
+    if err := recipe.Encode(file); err != nil {
+        file.Close()
+        return err
+    }
+    if err := file.Close(); err != nil {
+        return pserrors.IO("close", path, err)
+    }
+    return nil
+}
@@ -0,0 +1,408 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "crypto/rand"
+    "embed"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "image"
+    "io"
+    "mime"
+    "net/http"
+    "net/url"
+    "os"
+    "os/signal"
+    "runtime"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    pserrors "github.com/faceplate-kleo/pixelsorter/lib/errors"
+    f "github.com/faceplate-kleo/pixelsorter/lib/flags"
+    "github.com/faceplate-kleo/pixelsorter/lib/nrgbautil"
+    "github.com/faceplate-kleo/pixelsorter/lib/registry"
+    "github.com/faceplate-kleo/pixelsorter/src/core"
+)
+
+//go:embed web
+var webFiles embed.FS
+
+const (
+    defaultServeAddr = "localhost:8080"
+    // maxUploadBytes bounds every request body.
+    maxUploadBytes = 64 << 20
+    // maxUploadPixels bounds the decoded size of an upload, which a small
+    // compressed file can inflate far beyond maxUploadBytes.
+    maxUploadPixels = 64 << 20
+    // maxStoredImages is how many uploads are kept; the oldest go first.
+    maxStoredImages = 16
+)
+
+// server keeps uploaded images in memory and renders recipes on them.
+type server struct {
+    base *core.Recipe
+    // slots limits how many renders run at once.
+    slots chan struct{}
+
+    mu sync.Mutex
+    images map[string]*storedImage
+    order []string
+}
+
+// storedImage is an upload along with the downscaled copies made of it.
+type storedImage struct {
+    full *image.NRGBA
+    mu sync.Mutex
+    scaled map[int]*image.NRGBA
+}
+
+func (s *storedImage) at(maxSide int) *image.NRGBA {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if scaled, ok := s.scaled[maxSide]; ok {
+        return scaled
+    }
+    scaled := nrgbautil.Downscale(s.full, maxSide)
+    s.scaled[maxSide] = scaled
+    return scaled
+}
+
+// httpError is an error with the status to answer it with.
+type httpError struct {
+    status int
+    err error
+}
+
+func (e *httpError) Error() string { return e.err.Error() }
+func (e *httpError) Unwrap() error { return e.err }
+
+func runServe(args []string) error {
+    c := newRenderCmd("serve", "Serve a web page for tuning a sort with sliders, and an HTTP API that renders recipes on uploaded images. "+
+        "The sort flags, -recipe and -preset set the recipe the page starts from.", "")
+    addr := defaultServeAddr
+    c.fs.StringVar(&addr, "addr", addr, "Address to listen on. Anything but localhost exposes the server to the network")
+    c.fs.Parse(args)
+
+    base, err := c.recipe(nil)
+    if err != nil {
+        return err
+    }
+    base.Input, base.Output, base.MaskOutput = "", "", ""
+    if err := checkServable(base); err != nil {
+        return err
+    }
+    s := &server{base: base, slots: make(chan struct{}, runtime.NumCPU()), images: map[string]*storedImage{}}
+
+    srv := &http.Server{Addr: addr, Handler: s.routes(), ReadHeaderTimeout: 10 * time.Second}
+    ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+    defer stop()
+    go func() {
+        <-ctx.Done()
+        shutdown, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+        defer cancel()
+        srv.Shutdown(shutdown)
+    }()
+
+    fmt.Fprintf(os.Stderr, "serving on http://%s, ctrl-c to stop\n", addr)
+    if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+        return err
+    }
+    return nil
+}
+
+func (s *server) routes() http.Handler {
+    mux := http.NewServeMux()
+    mux.HandleFunc("/", s.handleIndex)
+    mux.HandleFunc("/api/options", s.handle(http.MethodGet, s.options))
+    mux.HandleFunc("/api/recipe", s.handle(http.MethodGet, s.recipe))
+    mux.HandleFunc("/api/presets/", s.handle(http.MethodGet, s.preset))
+    mux.HandleFunc("/api/images", s.handle(http.MethodPost, s.upload))
+    mux.HandleFunc("/api/render", s.handleRender)
+    return mux
+}
+
+func (s *server) handleIndex(w http.ResponseWriter, r *http.Request) {
+    if r.URL.Path != "/" {
+        http.NotFound(w, r)
+        return
+    }
+    page, _ := webFiles.ReadFile("web/index.html")
+    w.Header().Set("Content-Type", "text/html; charset=utf-8")
+    w.Write(page)
+}
+
+// handle answers a JSON endpoint. Errors are answered as {"error": "..."}.
+func (s *server) handle(method string, fn func(r *http.Request) (any, error)) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        if r.Method != method {
+            writeHTTPError(w, &httpError{http.StatusMethodNotAllowed, fmt.Errorf("%s only", method)})
+            return
+        }
+        if err := checkOrigin(r); err != nil {
+            writeHTTPError(w, err)
+            return
+        }
+        r.Body = http.MaxBytesReader(w, r.Body, maxUploadBytes)
+        v, err := fn(r)
+        if err != nil {
+            writeHTTPError(w, err)
+            return
+        }
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(v)
+    }
+}
+
+// checkOrigin turns away requests that browsers send on behalf of other web
+// pages. Requests from outside a browser carry no Origin and pass.
+func checkOrigin(r *http.Request) error {
+    origin := r.Header.Get("Origin")
+    if origin == "" {
+        return nil
+    }
+    if u, err := url.Parse(origin); err == nil && u.Host == r.Host {
+        return nil
+    }
+    return &httpError{http.StatusForbidden, fmt.Errorf("requests from %s are not allowed", origin)}
+}
+
+func writeHTTPError(w http.ResponseWriter, err error) {
+    status := http.StatusInternalServerError
+    var httpErr *httpError
+    var tooLarge *http.MaxBytesError
+    switch {
+    case errors.As(err, &httpErr):
+        status = httpErr.status
+    case errors.As(err, &tooLarge):
+        status = http.StatusRequestEntityTooLarge
+    case errors.Is(err, pserrors.ErrInvalidOptions), errors.Is(err, pserrors.ErrUnsupportedFormat):
+        status = http.StatusBadRequest
+    default:
+        var formatErr *pserrors.FormatError
+        if errors.As(err, &formatErr) {
+            status = http.StatusBadRequest
+        }
+    }
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(status)
+    json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
+
+// options lists what the page offers in its menus.
+func (s *server) options(r *http.Request) (any, error) {
+    presets, err := core.ListPresets()
+    if err != nil {
+        return nil, err
+    }
+    type preset struct {
+        Name string `json:"name"`
+        Description string `json:"description"`
+    }
+    listed := []preset{}
+    for _, p := range presets {
+        listed = append(listed, preset{p.Name, p.Description})
+    }
+    return map[string]any{
+        "directions": []string{"right", "left", "down", "up"},
+        "keys": registry.Keys.Names(),
+        "presets": listed,
+    }, nil
+}
+
+func (s *server) recipe(r *http.Request) (any, error) {
+    return s.base, nil
+}
+
+func (s *server) preset(r *http.Request) (any, error) {
+    recipe, err := core.LoadPreset(strings.TrimPrefix(r.URL.Path, "/api/presets/"))
+    if err != nil {
+        return nil, &httpError{http.StatusNotFound, err}
+    }
+    return recipe, nil
+}
+
+// upload stores an image sent as the request body or as the "image" field
+// of a form.
+func (s *server) upload(r *http.Request) (any, error) {
+    imData, err := readUpload(r)
+    if err != nil {
+        return nil, err
+    }
+    id := newImageID()
+    s.mu.Lock()
+    s.images[id] = &storedImage{full: imData, scaled: map[int]*image.NRGBA{}}
+    s.order = append(s.order, id)
+    if len(s.order) > maxStoredImages {
+        delete(s.images, s.order[0])
+        s.order = s.order[1:]
+    }
+    s.mu.Unlock()
+    bounds := imData.Bounds()
+    return map[string]any{"id": id, "width": bounds.Dx(), "height": bounds.Dy()}, nil
+}
+
+func readUpload(r *http.Request) (*image.NRGBA, error) {
+    if !isMultipart(r) {
+        return decodeUpload(r.Body)
+    }
+    file, _, err := r.FormFile("image")
+    if err != nil {
+        return nil, &httpError{http.StatusBadRequest, fmt.Errorf("image field: %w", err)}
+    }
+    defer file.Close()
+    return decodeUpload(file)
+}
+
+// decodeUpload decodes an image after checking from its header that it fits
+// in maxUploadPixels.
+func decodeUpload(r io.Reader) (*image.NRGBA, error) {
+    data, err := io.ReadAll(r)
+    if err != nil {
+        return nil, err
+    }
+    //undecodable headers are left to DecodeImage to report
+    if config, _, err := image.DecodeConfig(bytes.NewReader(data)); err == nil {
+        if pixels := int64(config.Width) * int64(config.Height); pixels > maxUploadPixels {
+            return nil, &httpError{http.StatusRequestEntityTooLarge,
+                fmt.Errorf("image of %dx%d pixels is over the limit of %d megapixels", config.Width, config.Height, maxUploadPixels>>20)}
+        }
+    }
+    return nrgbautil.DecodeImage(bytes.NewReader(data))
+}
+
+func isMultipart(r *http.Request) bool {
+    mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+    return mediaType == "multipart/form-data"
+}
+
+func newImageID() string {
+    id := make([]byte, 8)
+    rand.Read(id)
+    return hex.EncodeToString(id)
+}
+
+// renderRequest is the JSON body of /api/render. Image is the id of an
+// upload. MaxSide downscales the image first, 0 renders at full size.
+type renderRequest struct {
+    Image string `json:"image"`
+    Recipe json.RawMessage `json:"recipe"`
+    MaxSide int `json:"max_side"`
+}
+
+// handleRender renders a recipe and answers with the image. The request is
+// either JSON naming an upload, or a form with an "image" file and optional
+// "recipe" and "max_side" fields. Without a recipe the served one is used.
+func (s *server) handleRender(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        writeHTTPError(w, &httpError{http.StatusMethodNotAllowed, errors.New("POST only")})
+        return
+    }
+    if err := checkOrigin(r); err != nil {
+        writeHTTPError(w, err)
+        return
+    }
+    r.Body = http.MaxBytesReader(w, r.Body, maxUploadBytes)
+    imData, recipe, err := s.renderInput(r)
+    if err != nil {
+        writeHTTPError(w, err)
+        return
+    }
+
+    select {
+    case s.slots <- struct{}{}:
+        defer func() { <-s.slots }()
+    case <-r.Context().Done():
+        return
+    }
+    passes, err := recipe.ToPasses()
+    if err != nil {
+        writeHTTPError(w, err)
+        return
+    }
+    imData = nrgbautil.DataToNrgbaSeeded(imData, f.Flags{SOURCE_DEBUG: recipe.SourceDebug}, recipe.Seed)
+    sorted, _, err := core.SortPasses(imData, passes)
+    if err != nil {
+        writeHTTPError(w, err)
+        return
+    }
+    var encoded bytes.Buffer
+    if err := nrgbautil.Encode(&encoded, sorted, recipe.Format); err != nil {
+        writeHTTPError(w, err)
+        return
+    }
+    w.Header().Set("Content-Type", "image/"+orDefault(strings.ToLower(recipe.Format), "png"))
+    w.Header().Set("X-Pixelsorter-Seed", strconv.FormatInt(recipe.Seed, 10))
+    w.Write(encoded.Bytes())
+}
+
+func (s *server) renderInput(r *http.Request) (*image.NRGBA, *core.Recipe, error) {
+    req := renderRequest{}
+    var imData *image.NRGBA
+    //a text/plain body would pass for JSON without a preflight
+    mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+    if mediaType != "application/json" && mediaType != "multipart/form-data" {
+        return nil, nil, &httpError{http.StatusUnsupportedMediaType, errors.New("send application/json or multipart/form-data")}
+    }
+    if mediaType == "multipart/form-data" {
+        var err error
+        if imData, err = readUpload(r); err != nil {
+            return nil, nil, err
+        }
+        req.Recipe = json.RawMessage(r.FormValue("recipe"))
+        if maxSide := r.FormValue("max_side"); maxSide != "" {
+            if req.MaxSide, err = strconv.Atoi(maxSide); err != nil {
+                return nil, nil, fmt.Errorf("%w: max_side %q", pserrors.ErrInvalidOptions, maxSide)
+            }
+        }
+    } else {
+        if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+            return nil, nil, fmt.Errorf("%w: render request: %v", pserrors.ErrInvalidOptions, err)
+        }
+        s.mu.Lock()
+        stored, ok := s.images[req.Image]
+        s.mu.Unlock()
+        if !ok {
+            return nil, nil, &httpError{http.StatusNotFound, fmt.Errorf("no image %q, upload it to /api/images first", req.Image)}
+        }
+        imData = stored.at(req.MaxSide)
+    }
+    if req.MaxSide > 0 {
+        imData = nrgbautil.Downscale(imData, req.MaxSide)
+    }
+
+    recipe := *s.base
+    if len(req.Recipe) > 0 {
+        decoded, err := core.DecodeRecipe(bytes.NewReader(req.Recipe))
+        if err != nil {
+            return nil, nil, err
+        }
+        recipe = *decoded
+    }
+    if err := checkServable(&recipe); err != nil {
+        return nil, nil, err
+    }
+    //previews stay comparable while only the settings change
+    if recipe.Seed == 0 {
+        recipe.Seed = s.base.Seed
+    }
+    return imData, &recipe, nil
+}
+
+// checkServable keeps recipes from reading files on the server, and from
+// asking for more than a still image.
+func checkServable(recipe *core.Recipe) error {
+    if recipe.Animation != nil {
+        return fmt.Errorf("%w: the server renders still images only", pserrors.ErrInvalidOptions)
+    }
+    for i, pass := range recipe.Passes {
+        if pass.Mask.Path != "" {
+            return fmt.Errorf("%w: pass %d: mask files can not be used over http", pserrors.ErrInvalidOptions, i+1)
+        }
+    }
+    return nil
+}
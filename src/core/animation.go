@@ -0,0 +1,76 @@
+package core
+
+import (
+    "context"
+    "fmt"
+    "image"
+    "time"
+
+    "github.com/faceplate-kleo/pixelsorter/lib/anim"
+    f "github.com/faceplate-kleo/pixelsorter/lib/flags"
+    psmath "github.com/faceplate-kleo/pixelsorter/lib/math"
+)
+
+// AnimationFromSingleFrame is the path based wrapper around Animation. With
+// flags.WRITE_FRAMES, outPath is a directory the frames are written into as
+// numbered PNGs, and otherwise the path of a GIF.
+func AnimationFromSingleFrame(
+        imData_nrgb *image.NRGBA, 
+        outPath, direction string, 
+        threshold, noiseFactor, frames int, 
+        scalar float64,
+        flags f.Flags,
+    ) error {
+    opts := OptionsFromFlags(flags)
+    opts.Direction = direction
+    opts.Threshold = threshold
+    opts.NoiseFactor = noiseFactor
+    opts.Scalar = scalar
+
+    return anim.Render(wrapperFormat(flags), outPath, func(sink anim.FrameSink) error {
+        return Animation(context.Background(), imData_nrgb, sink, opts, frames, nil)
+    })
+}
+
+// wrapperFormat is the animation format the path based wrappers write.
+func wrapperFormat(flags f.Flags) string {
+    if flags.WRITE_FRAMES {
+        return "frames"
+    }
+    return "gif"
+}
+
+// Animation sorts imData frames times with the same options and hands the
+// results to sink. Frames only differ through noise. The caller closes the
+// sink. If ctx is cancelled the remaining frames are skipped and the context
+// error is returned. progress may be nil.
+func Animation(ctx context.Context, imData image.Image, sink anim.FrameSink, opts Options, frames int, progress ProgressFunc) error {
+    sorter, err := NewSorter(opts)
+    if err != nil {
+        return err
+    }
+    seed := sorter.Options().Seed
+    began := time.Now()
+    for frame := 0; frame < frames; frame++ {
+        if ctx.Err() != nil {
+            return fmt.Errorf("stopped after %d of %d frames: %w", frame, frames, ctx.Err())
+        }
+        frame_opts := opts
+        frame_opts.Seed = psmath.SubSeed(seed, int64(frame))
+        sorter, err := NewSorter(frame_opts)
+        if err != nil {
+            return err
+        }
+        sorted, _, err := sorter.Sort(imData)
+        if err != nil {
+            return err
+        }
+        if err := sink.WriteFrame(frame, sorted, 0); err != nil {
+            return fmt.Errorf("frame %d: %w", frame, err)
+        }
+        if progress != nil {
+            progress(Progress{Done: frame + 1, Total: frames, Elapsed: time.Since(began)})
+        }
+    }
+    return nil
+}
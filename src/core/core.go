@@ -1,30 +1,36 @@
 package core
 
 import (
+    "context"
     "fmt"
     "image"
     "image/color"
-    "image/color/palette"
-    "image/gif"
     "image/draw"
-    "image/png"
-    "log"
+    "io"
     "os"
+    "runtime"
     "math"
-    "math/rand"
     "sort"
     "strings"
     "sync"
+    "time"
 
 
+    "github.com/faceplate-kleo/pixelsorter/lib/anim"
+    pserrors "github.com/faceplate-kleo/pixelsorter/lib/errors"
     "github.com/faceplate-kleo/pixelsorter/lib/wave"
     "github.com/faceplate-kleo/pixelsorter/lib/masks"
     "github.com/faceplate-kleo/pixelsorter/lib/nrgbautil"
     f "github.com/faceplate-kleo/pixelsorter/lib/flags"
     psmath "github.com/faceplate-kleo/pixelsorter/lib/math"
+    "github.com/faceplate-kleo/pixelsorter/lib/registry"
 
 )
 
+// SortNrgbaImage is the original positional entry point, kept for
+// compatibility. New code should build a Sorter from Options instead. The mask,
+// if given, must already be in the sort orientation, and the returned mask is
+// in the sort orientation too.
 func SortNrgbaImage(
         imData_nrgb *image.NRGBA, 
         threshold int, 
@@ -34,74 +40,170 @@ func SortNrgbaImage(
         signal []int, 
         mask *image.NRGBA,
         flags f.Flags,
-    ) (*image.NRGBA, *image.NRGBA) {
-    direction = strings.ToLower(direction)
-    if direction == "up" {
-        imData_nrgb = nrgbautil.RotateNrgba(imData_nrgb, 1)
-    } else if direction == "down" {
-        imData_nrgb = nrgbautil.RotateNrgba(imData_nrgb, 3)
-    } else if direction == "left" {
-        imData_nrgb = nrgbautil.FlipNrgba(imData_nrgb, true)
+    ) (*image.NRGBA, *image.NRGBA, error) {
+    opts := OptionsFromFlags(flags)
+    opts.Direction = strings.ToLower(direction)
+    opts.Threshold = threshold
+    opts.Scalar = scalar
+    opts.NoiseFactor = noiseFactor
+    opts.MaskPath = maskInPath
+    opts.Signal = signal
+    return SortSpans(imData_nrgb, mask, opts)
+}
+
+// SortSpans is the "span" mode: runs of white mask pixels are sorted along the
+// sort direction.
+func SortSpans(imData_nrgb *image.NRGBA, mask *image.NRGBA, opts Options) (*image.NRGBA, *image.NRGBA, error) {
+    flags := opts.Flags()
+    imData_nrgb = OrientNrgba(imData_nrgb, opts.Direction)
+    mask, err := BuildMask(imData_nrgb, mask, opts)
+    if err != nil {
+        return nil, nil, err
     }
-    if maskInPath == "" {
-        if mask == nil {
-            mask = masks.CreateContrastMask(imData_nrgb, uint8(threshold), flags)
-        }
-    } else {
-        mask = masks.ReadContrastMask(maskInPath, imData_nrgb.Bounds())
+    sorted := CreateSortedFromMaskSeeded(imData_nrgb, mask, opts.Scalar, opts.NoiseFactor, opts.Signal, flags, opts.Seed)
+    sorted = RestoreNrgba(sorted, opts.Direction)
+
+    return sorted, mask, nil
+}
+
+// BuildMask returns the mask for an image that is already in the sort
+// orientation. A mask file takes priority, then a precomputed mask, then a
+// fresh mask from the registered generator named by opts.MaskGen.
+func BuildMask(imData *image.NRGBA, mask *image.NRGBA, opts Options) (*image.NRGBA, error) {
+    if opts.MaskPath != "" {
+        return ReadMask(opts.MaskPath, imData.Bounds(), opts.orientation())
+    }
+    if mask != nil {
+        return mask, nil
     }
-    sorted := CreateSortedFromMask(imData_nrgb, mask, scalar, noiseFactor, signal, flags)
-
-    if direction == "up" {
-        imData_nrgb = nrgbautil.RotateNrgba(sorted, 3)
-        sorted = nrgbautil.RotateNrgba(sorted, 3)
-    } else if direction == "down" {
-        imData_nrgb = nrgbautil.RotateNrgba(sorted, 1)
-        sorted = nrgbautil.RotateNrgba(sorted, 1)
-    } else if direction == "left" {
-        imData_nrgb = nrgbautil.FlipNrgba(imData_nrgb, true)
-        sorted = nrgbautil.FlipNrgba(sorted , true)
+    generate, err := opts.maskFunc()
+    if err != nil {
+        return nil, err
     }
+    mask = generate(imData)
+    if opts.DebugMask {
+        draw.Draw(mask, mask.Rect, image.White, image.Point{}, draw.Src)
+    }
+    return mask, nil
+}
 
-    return sorted, mask 
+// ReadMask reads a mask file drawn against the image as the user sees it, and
+// turns it into the sort orientation of direction. oriented is the bounds of
+// the image in the sort orientation.
+func ReadMask(path string, oriented image.Rectangle, direction string) (*image.NRGBA, error) {
+    bounds := oriented
+    direction = strings.ToLower(direction)
+    if direction == "up" || direction == "down" {
+        bounds = image.Rect(oriented.Min.Y, oriented.Min.X, oriented.Max.Y, oriented.Max.X)
+    }
+    mask, err := masks.ReadContrastMask(path, bounds)
+    if err != nil {
+        return nil, err
+    }
+    return OrientNrgba(mask, direction), nil
 }
 
+// WaveAnimationFromSingleFrame is the path based wrapper around WaveAnimation.
+// With flags.WRITE_FRAMES, outPath is a directory the frames are written into
+// as numbered PNGs, and otherwise the path of a GIF.
 func WaveAnimationFromSingleFrame(
         imData *image.NRGBA, 
         wavPath, maskPath, outPath, direction string, 
         threshold, noisefactor, framerate, num_buckets int, 
         scalar float64, 
         flags f.Flags,
-    ) {
-    waveStack, numFrames := wave.CreateWaveStack(wavPath, framerate, num_buckets)
-    delay := int(1.0 / float64(framerate) * 100.0)
+    ) error {
+    opts := OptionsFromFlags(flags)
+    opts.Direction = direction
+    opts.Threshold = threshold
+    opts.NoiseFactor = noisefactor
+    opts.Scalar = scalar
+    opts.MaskPath = maskPath
+
+    wavfile, err := os.Open(wavPath)
+    if err != nil {
+        return pserrors.IO("open", wavPath, err)
+    }
+    defer wavfile.Close()
+
+    return anim.Render(wrapperFormat(flags), outPath, func(sink anim.FrameSink) error {
+        return WaveAnimation(context.Background(), imData, wavfile, sink, opts, framerate, num_buckets, nil)
+    })
+}
+
+// WaveAnimation sorts imData once per frame of the .wav stream, driving span
+// lengths with the frame's frequency buckets, and hands the frames to sink.
+// The caller closes the sink. If ctx is cancelled, frames that have not
+// started are dropped and the context error is returned. progress may be nil.
+func WaveAnimation(
+        ctx context.Context, 
+        imData image.Image, 
+        wav io.Reader, 
+        sink anim.FrameSink, 
+        opts Options, 
+        framerate, num_buckets int, 
+        progress ProgressFunc,
+    ) error {
+    delay := anim.DelayFor(framerate)
+    return waveFrames(ctx, imData, wav, opts, framerate, num_buckets, progress, func(frame int, sorted *image.NRGBA) error {
+        return sink.WriteFrame(frame, sorted, delay)
+    })
+}
 
-    res := imData.Bounds() 
-    resY := res.Dy()
+// waveRender is what the frames of a wave animation share: the image, the
+// buckets of every frame and one mask for all of them.
+type waveRender struct {
+    full, imData *image.NRGBA
+    waveStack [][]int
+    numFrames int
+    numBuckets int
+    maxAmp int
+    // mask is in the sort orientation.
+    mask *image.NRGBA
+    opts Options
+}
+
+func newWaveRender(img image.Image, wav io.Reader, opts Options, framerate, num_buckets int) (*waveRender, error) {
+    waveStack, numFrames, err := wave.WaveStackFromReader(wav, framerate, num_buckets)
+    if err != nil {
+        return nil, err
+    }
 
-    paletted_anim := make([]*image.Paletted, numFrames) 
-    raw_delay := make([]int, numFrames)
+    full := nrgbautil.ToNrgba(img)
+    imData := full
+    if !opts.Region.Empty() {
+        var region image.Rectangle
+        if region, opts, err = opts.cropRegion(full.Bounds()); err != nil {
+            return nil, err
+        }
+        imData = full.SubImage(region).(*image.NRGBA)
+    }
 
     //huge time save to do this only one time
-    //TODO: make the rotation literally ANY less hacky
+    opts.Direction = strings.ToLower(opts.Direction)
     mask_copy := image.NewNRGBA(imData.Bounds())
     draw.Draw(mask_copy, mask_copy.Rect, imData, imData.Bounds().Min, draw.Over)
-    direction = strings.ToLower(direction)
-    if direction == "up" {
-        mask_copy = nrgbautil.RotateNrgba(mask_copy, 1)
-    } else if direction == "down" {
-        mask_copy = nrgbautil.RotateNrgba(mask_copy, 3)
-    } else if direction == "left" {
-        mask_copy = nrgbautil.FlipNrgba(mask_copy, true)
-    }
-    var master_mask *image.NRGBA 
-    if maskPath == "" {
-        master_mask = masks.CreateContrastMask(mask_copy, uint8(threshold), flags)
+    mask_copy = OrientNrgba(mask_copy, opts.Direction)
+
+    var master_mask *image.NRGBA
+    if opts.Mask != nil && opts.MaskPath == "" {
+        master_mask, err = masks.MaskFromImage(opts.Mask, imData.Bounds())
+        if err == nil {
+            master_mask = OrientNrgba(master_mask, opts.Direction)
+        }
     } else {
-        master_mask = masks.ReadContrastMask(maskPath, imData.Bounds())
+        master_mask, err = BuildMask(mask_copy, nil, opts)
+    }
+    if err != nil {
+        return nil, err
+    }
+    opts.Mask = nil
+    opts.MaskPath = ""
+    if opts.Seed == 0 {
+        opts.Seed = psmath.RandomSeed()
     }
 
-    max_amp := -1 
+    max_amp := 1
     for frame := 0; frame < numFrames; frame++ {
         buckets_clone := make([]int, num_buckets)
         copy(buckets_clone, waveStack[frame])
@@ -111,54 +213,123 @@ func WaveAnimationFromSingleFrame(
             max_amp = frame_peak
         }
     }
+    return &waveRender{
+        full: full,
+        imData: imData,
+        waveStack: waveStack,
+        numFrames: numFrames,
+        numBuckets: num_buckets,
+        maxAmp: max_amp,
+        mask: master_mask,
+        opts: opts,
+    }, nil
+}
+
+// frameOptions are the options of one frame, with the signal of its buckets.
+func (w *waveRender) frameOptions(frame int) Options {
+    resY := w.imData.Bounds().Dy()
+    signal := make([]int, resY)
+    for col := 0; col < resY; col++ {
+        this_bucket := int((float64(col) / float64(resY)) * float64(w.numBuckets))
+        amplitude := w.waveStack[frame][this_bucket]
+        amplitude = int(float64(amplitude) / float64(w.maxAmp) * float64(resY))
+        signal[col] = amplitude
+    }
+    frame_opts := w.opts
+    frame_opts.Signal = signal
+    frame_opts.Seed = psmath.SubSeed(w.opts.Seed, int64(frame))
+    return frame_opts
+}
+
+// sortFrame renders one frame.
+func (w *waveRender) sortFrame(frame int) (*image.NRGBA, error) {
+    imData_copy := image.NewNRGBA(w.imData.Bounds())
+    draw.Draw(imData_copy, imData_copy.Rect, w.imData, w.imData.Bounds().Min, draw.Over)
+    sorted, _, err := SortSpans(imData_copy, w.mask, w.frameOptions(frame))
+    if err == nil && w.imData != w.full {
+        sorted = pasteRegion(w.full, sorted)
+    }
+    return sorted, err
+}
+
+// waveFrames renders the frames on a pool of GOMAXPROCS workers. emit is
+// called from the workers as frames finish. The first error, or cancellation
+// of ctx, stops any frames that have not started yet.
+func waveFrames(
+        ctx context.Context, 
+        img image.Image, 
+        wav io.Reader, 
+        opts Options, 
+        framerate, num_buckets int, 
+        progress ProgressFunc, 
+        emit func(frame int, sorted *image.NRGBA) error,
+    ) error {
+    began := time.Now()
+    render, err := newWaveRender(img, wav, opts, framerate, num_buckets)
+    if err != nil {
+        return err
+    }
+    numFrames := render.numFrames
+
+    ctx, cancel := context.WithCancel(ctx)
+    defer cancel()
+
+    jobs := make(chan int)
+    go func() {
+        defer close(jobs)
+        for frame := 0; frame < numFrames; frame++ {
+            select {
+            case jobs <- frame:
+            case <-ctx.Done():
+                return
+            }
+        }
+    }()
 
     var wg sync.WaitGroup
-    for frame := 0; frame < numFrames; frame++ { 
-        imData_copy := image.NewNRGBA(imData.Bounds())
-        draw.Draw(imData_copy, imData_copy.Rect, imData, imData.Bounds().Min, draw.Over)
+    var mu sync.Mutex
+    var frameErr error
+    done := 0
+    for worker := 0; worker < runtime.GOMAXPROCS(0); worker++ {
         wg.Add(1)
-        go func(frame, resY int, imData *image.NRGBA) { 
+        go func() {
             defer wg.Done()
-            signal := make([]int, resY)
-            for col := 0; col < resY; col++ {
-                this_bucket := int((float64(col) / float64(resY)) * float64(num_buckets))
-                amplitude := waveStack[frame][this_bucket]
-                amplitude = int(float64(amplitude) / float64(max_amp) * float64(resY))
-                signal[col] = amplitude
-            }
-            sorted, _ := SortNrgbaImage(imData, threshold, scalar, noisefactor, direction, "", signal, master_mask, flags)
+            for frame := range jobs {
+                if ctx.Err() != nil {
+                    continue
+                }
+                sorted, err := render.sortFrame(frame)
+                if err == nil {
+                    err = emit(frame, sorted)
+                }
 
-            if flags.WRITE_FRAMES {
-                frameID := "FRAME_" + fmt.Sprint(frame)
-                fileout := "./frames/" + frameID + ".png"
-                fileobj, err := os.Create(fileout)
+                mu.Lock()
                 if err != nil {
-                    log.Fatal(err)
+                    if frameErr == nil {
+                        frameErr = fmt.Errorf("frame %d: %w", frame, err)
+                    }
+                    cancel()
+                } else {
+                    done++
+                    if progress != nil {
+                        progress(Progress{Done: done, Total: numFrames, Elapsed: time.Since(began)})
+                    }
                 }
-                png.Encode(fileobj, sorted)
-            } else {
-                frame_img := image.NewPaletted(res, palette.Plan9)
-                draw.Draw(frame_img, frame_img.Rect, sorted, sorted.Bounds().Min, draw.Over)
-                paletted_anim[frame] = frame_img
-                raw_delay[frame] = delay
+                mu.Unlock()
             }
-        }(frame, resY, imData_copy)
+        }()
     }
-    if !flags.WRITE_FRAMES {
-        wg.Wait()
-        outGif := &gif.GIF{}
-        outGif.Image = paletted_anim
-        outGif.Delay = raw_delay 
-        
-        giffile, err := os.Create(outPath)
-        if err != nil {
-            log.Fatal(err)
-        }
-        gif.EncodeAll(giffile, outGif)
-        giffile.Close()
+    wg.Wait()
+    if frameErr != nil {
+        return frameErr
     }
+    if done < numFrames {
+        return fmt.Errorf("stopped after %d of %d frames: %w", done, numFrames, ctx.Err())
+    }
+    return nil
 }
 
+// CreateSortedFromMask is CreateSortedFromMaskSeeded with a random seed.
 func CreateSortedFromMask(
         imData image.Image, 
         mask *image.NRGBA, 
@@ -167,9 +338,32 @@ func CreateSortedFromMask(
         signal []int,
         flags f.Flags,
     ) *image.NRGBA {
+    return CreateSortedFromMaskSeeded(imData, mask, scalar, noiseFactor, signal, flags, psmath.RandomSeed())
+}
+
+// CreateSortedFromMaskSeeded sorts the spans of imData that start on the
+// white runs of mask. seed drives the noise and debug colors, the same seed
+// gives the same output. flags.ANCHOR must name a registered interval, as
+// Options.Validate checks; otherwise spans are left unanchored.
+func CreateSortedFromMaskSeeded(
+        imData image.Image, 
+        mask *image.NRGBA, 
+        scalar float64, 
+        noiseFactor int, 
+        signal []int,
+        flags f.Flags,
+        seed int64,
+    ) *image.NRGBA {
+    //spans are worked out relative to the top left corner
+    if origin := imData.Bounds().Min; origin != (image.Point{}) {
+        local := nrgbautil.Reorigin(nrgbautil.ToNrgba(imData), image.Point{})
+        sorted := CreateSortedFromMaskSeeded(local, nrgbautil.Reorigin(mask, image.Point{}), scalar, noiseFactor, signal, flags, seed)
+        return nrgbautil.Reorigin(sorted, origin)
+    }
     output := image.NewNRGBA(imData.Bounds())
     horizontal_domain := mask.Bounds().Dx()
     vertical_domain := mask.Bounds().Dy()
+    interval, _ := spanInterval(flags)
 
     outer_bound := vertical_domain 
     inner_bound := horizontal_domain
@@ -178,6 +372,8 @@ func CreateSortedFromMask(
 
     for i := 0; i < outer_bound; i++ {
         j_written = make(map[int]bool)
+        //every row gets its own generator so rows do not depend on each other
+        rng := psmath.NewRand(psmath.SubSeed(seed, int64(i)))
         for j := 0; j < inner_bound; j++ {
             if masks.ColorIsWhite(mask.At(j,i)){
                 adjusted_j := j 
@@ -186,12 +382,12 @@ func CreateSortedFromMask(
                 noiseAmt := 0.0
                 if noiseFactor != 0 {
                     if noiseFactor > 0 {
-                        noiseAmt = float64(rand.Intn(noiseFactor))
+                        noiseAmt = float64(rng.Intn(noiseFactor))
                     } else {
                         pos_noise := noiseFactor * -1
                         half_noise := pos_noise / 2 
 
-                        noiseRaw := rand.Intn(pos_noise)
+                        noiseRaw := rng.Intn(pos_noise)
                         noiseAmt = float64(half_noise - noiseRaw)
                         if noiseAmt < 0 {
                             adjusted_j = psmath.IntMax (j + int(noiseAmt), 0)
@@ -219,11 +415,13 @@ func CreateSortedFromMask(
                     desired_span = span_x 
                 }
 
-                SortSpan(imData, adjusted_j, i, desired_span, span_y, output, flags)
-                for x := adjusted_j; x < desired_span; x++ {
+                span_start, span_end := anchorSpan(interval, j, adjusted_j, span_x, desired_span, horizontal_domain, flags)
+
+                sortSpanRand(imData, span_start, i, span_end, span_y, output, flags, &rng)
+                for x := span_start; x < span_end; x++ {
                     j_written[x] = true
                 }
-                j = desired_span
+                j = span_end
 
             } else {
                 if !j_written[j] {
@@ -237,7 +435,65 @@ func CreateSortedFromMask(
     return output
 }
 
+// AnchorSpan moves a forward span so that it is anchored as flags.INTERVAL, or
+// else the interval registered under flags.ANCHOR, asks: "start" (the
+// default) smears forward from the start of the mask run, "end" smears
+// backwards from its end, and "center" and "bidirectional" grow both ways
+// around it. An ANCHOR that names no registered interval is an error.
+func AnchorSpan(run_start, span_start, run_end, span_end, domain int, flags f.Flags) (int, int, error) {
+    interval, err := spanInterval(flags)
+    if err != nil {
+        return span_start, span_end, err
+    }
+    start, end := anchorSpan(interval, run_start, span_start, run_end, span_end, domain, flags)
+    return start, end, nil
+}
+
+// spanInterval is flags.INTERVAL, or else the interval registered under
+// flags.ANCHOR. It is nil when neither is set.
+func spanInterval(flags f.Flags) (registry.IntervalFunc, error) {
+    if flags.INTERVAL != nil || flags.ANCHOR == "" {
+        return flags.INTERVAL, nil
+    }
+    return registry.Intervals.New(flags.ANCHOR, nil)
+}
+
+// anchorSpan is AnchorSpan with the interval resolved. A nil interval leaves
+// the span as it is.
+func anchorSpan(interval registry.IntervalFunc, run_start, span_start, run_end, span_end, domain int, flags f.Flags) (int, int) {
+    if flags.CLEAN || flags.MASK_DEBUG || interval == nil {
+        return span_start, span_end
+    }
+    return interval(run_start, run_end, span_start, span_end, domain)
+}
+
+// applySpanOp runs the span op of flags over span, which defaults to sorting
+// it by the key of flags.
+func applySpanOp(span []color.Color, flags f.Flags, rng *psmath.Rand) {
+    sortSpan := func(s []color.Color) {
+        psmath.SpanMergesort(s, flags)
+    }
+    if flags.SPAN_OP == nil {
+        sortSpan(span)
+        return
+    }
+    flags.SPAN_OP(span, sortSpan, rng.Intn)
+}
+
+// SortSpan is SortSpanSeeded with a random seed.
 func SortSpan(imData image.Image, start_x, start_y, end_x, end_y int, output *image.NRGBA, flags f.Flags) {
+    SortSpanSeeded(imData, start_x, start_y, end_x, end_y, output, flags, psmath.RandomSeed())
+}
+
+// SortSpanSeeded sorts the pixels from start_x to end_x of row start_y into
+// output. seed drives the span op and debug color.
+func SortSpanSeeded(imData image.Image, start_x, start_y, end_x, end_y int, output *image.NRGBA, flags f.Flags, seed int64) {
+    rng := psmath.NewRand(seed)
+    sortSpanRand(imData, start_x, start_y, end_x, end_y, output, flags, &rng)
+}
+
+// sortSpanRand is SortSpan drawing from rng, which the spans of a row share.
+func sortSpanRand(imData image.Image, start_x, start_y, end_x, end_y int, output *image.NRGBA, flags f.Flags, rng *psmath.Rand) {
     //create a fast-sortable slice
     n := end_x - start_x + 1 
     toSort := make([]color.Color, n)
@@ -246,11 +502,15 @@ func SortSpan(imData image.Image, start_x, start_y, end_x, end_y int, output *im
     }
     //sort it 
 
-    sorted := psmath.SpanMergesort(toSort, flags)
+    applySpanOp(toSort, flags, rng)
+    sorted := toSort
+    if strings.EqualFold(flags.ANCHOR, "bidirectional") {
+        sorted = psmath.PeakOrder(sorted)
+    }
 
     //write the slice back out 
    
-    spanColor := psmath.GetRandomColor()
+    spanColor := psmath.RandomColor(rng)
     
     for j := 0; j < n; j++ {
         colorToWrite := sorted[j]
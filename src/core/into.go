@@ -0,0 +1,465 @@
+package core
+
+import (
+    "errors"
+    "fmt"
+    "image"
+    "image/color"
+    "image/draw"
+    "math"
+    "strings"
+    "sync"
+
+    pserrors "github.com/faceplate-kleo/pixelsorter/lib/errors"
+    f "github.com/faceplate-kleo/pixelsorter/lib/flags"
+    "github.com/faceplate-kleo/pixelsorter/lib/masks"
+    psmath "github.com/faceplate-kleo/pixelsorter/lib/math"
+    "github.com/faceplate-kleo/pixelsorter/lib/nrgbautil"
+    "github.com/faceplate-kleo/pixelsorter/lib/registry"
+)
+
+// SortInto sorts src into dst, which must be the same size and must not share
+// pixels with src. The result is identical to Sort. In span mode, scratch
+// space is pooled and a mask given by Options.Mask or MaskPath is only read
+// once, so once warmed up sorting further frames allocates next to nothing
+// with the "contrast" mask generator and the "sort" span op. Other modes,
+// generators, span ops and regions work too, but allocate like Sort does.
+func (s *Sorter) SortInto(dst, src *image.NRGBA) error {
+    if dst == nil || src == nil {
+        return errors.New("no image to sort")
+    }
+    if dst.Rect.Size() != src.Rect.Size() {
+        return fmt.Errorf("dst size %v does not match src size %v", dst.Rect.Size(), src.Rect.Size())
+    }
+    if len(dst.Pix) > 0 && len(src.Pix) > 0 && &dst.Pix[0] == &src.Pix[0] {
+        return errors.New("dst and src must not share pixels")
+    }
+    if s.opts.Mode != "span" || !s.opts.Region.Empty() {
+        sorted, _, err := s.Sort(src)
+        if err != nil {
+            return err
+        }
+        draw.Draw(dst, dst.Rect, sorted, sorted.Rect.Min, draw.Src)
+        return nil
+    }
+
+    sc, _ := s.scratch.Get().(*scratch)
+    if sc == nil {
+        sc = newScratch(s.flags)
+    }
+    defer s.scratch.Put(sc)
+
+    size := src.Rect.Size()
+    mask, err := s.intoMask(src, sc)
+    if err != nil {
+        return err
+    }
+    clearNrgba(dst)
+    s.sortSpansInto(dst, src, mask, size, sc)
+    return nil
+}
+
+// scratch is the working memory of one SortInto call. Buffers only ever grow.
+type scratch struct {
+    flags f.Flags
+    mask []bool
+    written []bool
+    px, work []color.NRGBA
+    keys, workKeys []float64
+    colors []color.Color
+
+    rng psmath.Rand
+    intn func(n int) int
+    // onSpan, when set, is told the length of every span within the line.
+    onSpan func(length int)
+    sortColors func(span []color.Color)
+}
+
+func newScratch(flags f.Flags) *scratch {
+    sc := &scratch{flags: flags}
+    sc.intn = sc.rng.Intn
+    sc.sortColors = func(span []color.Color) {
+        psmath.SpanMergesort(span, sc.flags)
+    }
+    return sc
+}
+
+func grow[T any](buf []T, n int) []T {
+    if cap(buf) < n {
+        return make([]T, n)
+    }
+    return buf[:n]
+}
+
+func clearNrgba(imData *image.NRGBA) {
+    row := imData.Rect.Dx() * 4
+    for y := 0; y < imData.Rect.Dy(); y++ {
+        pix := imData.Pix[y*imData.Stride : y*imData.Stride+row]
+        for k := range pix {
+            pix[k] = 0
+        }
+    }
+}
+
+// lineLayout maps the lines of a sort in some direction onto an image, so
+// that spans can be read and written in place instead of on a rotated copy.
+// Line i and position j of the sort orientation are the pixel at start +
+// i*lineStep + j*posStep, relative to the top left of the image.
+type lineLayout struct {
+    lines, length int
+    start, lineStep, posStep image.Point
+}
+
+func layoutFor(direction string, size image.Point) lineLayout {
+    w, h := size.X, size.Y
+    switch direction {
+    case "left":
+        return lineLayout{h, w, image.Pt(w-1, 0), image.Pt(0, 1), image.Pt(-1, 0)}
+    case "up":
+        return lineLayout{w, h, image.Pt(0, h-1), image.Pt(1, 0), image.Pt(0, -1)}
+    case "down":
+        return lineLayout{w, h, image.Pt(w-1, 0), image.Pt(-1, 0), image.Pt(0, 1)}
+    }
+    return lineLayout{h, w, image.Pt(0, 0), image.Pt(0, 1), image.Pt(1, 0)}
+}
+
+// offsets returns the index of the first pixel of line i and the step between
+// its pixels, in a buffer with the given stride and element size.
+func (l lineLayout) offsets(i, stride, elem int) (int, int) {
+    x := l.start.X + i*l.lineStep.X
+    y := l.start.Y + i*l.lineStep.Y
+    return y*stride + x*elem, l.posStep.Y*stride + l.posStep.X*elem
+}
+
+// intoMask returns the mask of src in image orientation, one bool per pixel
+// row by row, with the same precedence as BuildMask.
+func (s *Sorter) intoMask(src *image.NRGBA, sc *scratch) ([]bool, error) {
+    size := src.Rect.Size()
+    if s.opts.MaskPath != "" || s.opts.Mask != nil {
+        s.fixedOnce.Do(func() {
+            s.fixedMask, s.fixedErr = s.readFixedMask(size)
+        })
+        if s.fixedErr != nil {
+            return nil, s.fixedErr
+        }
+        if len(s.fixedMask) != size.X*size.Y {
+            return nil, &pserrors.MaskSizeError{Mask: image.Rectangle{Max: s.fixedSize}, Image: src.Rect}
+        }
+        return s.fixedMask, nil
+    }
+
+    sc.mask = grow(sc.mask, size.X*size.Y)
+    if s.opts.DebugMask {
+        for i := range sc.mask {
+            sc.mask[i] = true
+        }
+        return sc.mask, nil
+    }
+    if s.contrast == nil {
+        generated := s.maskGen(src)
+        if generated.Rect.Size() != size {
+            return nil, &pserrors.MaskSizeError{Mask: generated.Rect, Image: src.Rect}
+        }
+        maskToBools(sc.mask, generated)
+        return sc.mask, nil
+    }
+
+    //the contrast mask compares the low byte of the premultiplied red channel
+    threshold, invert := s.contrast.threshold, s.contrast.invert
+    for y := 0; y < size.Y; y++ {
+        row := src.Pix[y*src.Stride:]
+        for x := 0; x < size.X; x++ {
+            p := row[x*4 : x*4+4]
+            r := uint32(p[0])
+            r |= r << 8
+            r *= uint32(p[3])
+            r /= 0xff
+            sc.mask[y*size.X+x] = (uint8(r) < threshold) == invert
+        }
+    }
+    return sc.mask, nil
+}
+
+// readFixedMask reads the mask given in the options, which does not change
+// from frame to frame.
+func (s *Sorter) readFixedMask(size image.Point) ([]bool, error) {
+    var mask *image.NRGBA
+    if s.opts.MaskPath != "" {
+        read, err := masks.ReadContrastMask(s.opts.MaskPath, image.Rectangle{Max: size})
+        if err != nil {
+            return nil, err
+        }
+        mask = read
+    } else {
+        if s.opts.Mask.Bounds().Size() != size {
+            return nil, &pserrors.MaskSizeError{Mask: s.opts.Mask.Bounds(), Image: image.Rectangle{Max: size}}
+        }
+        mask = nrgbautil.ToNrgba(s.opts.Mask)
+    }
+    s.fixedSize = size
+    bools := make([]bool, size.X*size.Y)
+    maskToBools(bools, mask)
+    return bools, nil
+}
+
+func maskToBools(bools []bool, mask *image.NRGBA) {
+    w := mask.Rect.Dx()
+    for y := 0; y < mask.Rect.Dy(); y++ {
+        row := mask.Pix[y*mask.Stride:]
+        for x := 0; x < w; x++ {
+            p := row[x*4 : x*4+4]
+            bools[y*w+x] = p[0] == 0xff && p[1] == 0xff && p[2] == 0xff && p[3] == 0xff
+        }
+    }
+}
+
+// sortSpansInto is CreateSortedFromMask working on the lines of a layout.
+func (s *Sorter) sortSpansInto(dst, src *image.NRGBA, mask []bool, size image.Point, sc *scratch) {
+    opts := s.opts
+    flags := s.flags
+    layout := layoutFor(opts.Direction, size)
+    domain := layout.length
+    sc.written = grow(sc.written, domain)
+
+    for i := 0; i < layout.lines; i++ {
+        written := sc.written
+        for x := range written {
+            written[x] = false
+        }
+        sc.rng = psmath.NewRand(psmath.SubSeed(opts.Seed, int64(i)))
+        maskBase, maskStep := layout.offsets(i, size.X, 1)
+        srcBase, srcStep := layout.offsets(i, src.Stride, 4)
+        dstBase, dstStep := layout.offsets(i, dst.Stride, 4)
+        white := func(j int) bool {
+            return mask[maskBase + j*maskStep]
+        }
+
+        for j := 0; j < domain; j++ {
+            if !white(j) {
+                if !written[j] {
+                    copy(dst.Pix[dstBase + j*dstStep:dstBase + j*dstStep + 4], src.Pix[srcBase + j*srcStep:])
+                }
+                continue
+            }
+            adjusted_j := j
+            span_x := j
+            for span_x < domain && white(span_x) {
+                span_x++
+            }
+
+            noiseAmt := 0.0
+            if opts.NoiseFactor != 0 {
+                if opts.NoiseFactor > 0 {
+                    noiseAmt = float64(sc.rng.Intn(opts.NoiseFactor))
+                } else {
+                    pos_noise := opts.NoiseFactor * -1
+                    half_noise := pos_noise / 2
+
+                    noiseRaw := sc.rng.Intn(pos_noise)
+                    noiseAmt = float64(half_noise - noiseRaw)
+                    if noiseAmt < 0 {
+                        adjusted_j = psmath.IntMax(j + int(noiseAmt), 0)
+                    }
+                }
+            }
+
+            signal_amt := 0.0
+            if opts.Signal != nil {
+                signal_amt = psmath.SampleSignal(i, layout.lines, len(opts.Signal), opts.Signal)
+            }
+
+            final_span := math.Max(0.0, float64(span_x - j) + noiseAmt + signal_amt)
+            calculated_domain := int(float64(adjusted_j) + final_span * opts.Scalar)
+
+            desired_span := psmath.IntMin(calculated_domain, domain-1)
+            if flags.MASK_DEBUG {
+                desired_span = domain
+            }
+            if flags.CLEAN {
+                desired_span = span_x
+            }
+
+            span_start, span_end := anchorSpan(flags.INTERVAL, j, adjusted_j, span_x, desired_span, domain, flags)
+            if sc.onSpan != nil {
+                sc.onSpan(psmath.IntMin(span_end, domain-1) - psmath.IntMax(span_start, 0) + 1)
+            }
+
+            //spans include their end, which may lie just past the line
+            n := span_end - span_start + 1
+            sc.px = grow(sc.px, n)
+            for k := 0; k < n; k++ {
+                if p := span_start + k; p >= 0 && p < domain {
+                    o := srcBase + p*srcStep
+                    sc.px[k] = color.NRGBA{src.Pix[o], src.Pix[o+1], src.Pix[o+2], src.Pix[o+3]}
+                } else {
+                    sc.px[k] = color.NRGBA{}
+                }
+            }
+            s.spanOpInto(sc, n)
+
+            spanColor := psmath.RandomColor(&sc.rng)
+            for k := 0; k < n; k++ {
+                p := span_start + k
+                if p < 0 || p >= domain {
+                    continue
+                }
+                c := sc.px[k]
+                if flags.DEBUG {
+                    c = color.NRGBA{spanColor.R, spanColor.G, spanColor.B, 255}
+                }
+                if flags.MASK_DEBUG {
+                    r := uint32(c.R)
+                    r |= r << 8
+                    r *= uint32(c.A)
+                    r /= 0xff
+                    c = color.NRGBA{uint8(r), uint8(r), uint8(r), 255}
+                }
+                o := dstBase + p*dstStep
+                dst.Pix[o], dst.Pix[o+1], dst.Pix[o+2], dst.Pix[o+3] = c.R, c.G, c.B, c.A
+            }
+            for x := span_start; x < span_end && x < domain; x++ {
+                written[x] = true
+            }
+            j = span_end
+        }
+    }
+}
+
+// spanOpInto applies the span op to the first n pixels of sc.px, as SortSpan
+// does. The default sort works on the pixels directly; other ops are handed
+// pointers into sc.px, which box without allocating.
+func (s *Sorter) spanOpInto(sc *scratch, n int) {
+    px := sc.px[:n]
+    sc.work = grow(sc.work, n)
+    if s.opts.SpanOp == "" || s.opts.SpanOp == "sort" {
+        s.sortPixels(sc, px)
+    } else {
+        sc.colors = grow(sc.colors, n)
+        for k := range px {
+            sc.colors[k] = &px[k]
+        }
+        s.flags.SPAN_OP(sc.colors, sc.sortColors, sc.intn)
+        for k, c := range sc.colors {
+            if p, ok := c.(*color.NRGBA); ok {
+                sc.work[k] = *p
+            } else {
+                sc.work[k] = color.NRGBAModel.Convert(c).(color.NRGBA)
+            }
+        }
+        copy(px, sc.work)
+    }
+    if strings.EqualFold(s.flags.ANCHOR, "bidirectional") {
+        left, right := 0, n-1
+        for k := 0; k < n; k++ {
+            if k % 2 == 0 {
+                sc.work[left] = px[k]
+                left++
+            } else {
+                sc.work[right] = px[k]
+                right--
+            }
+        }
+        copy(px, sc.work)
+    }
+}
+
+// sortPixels is psmath.SpanMergesort on pixel values, with the keys worked
+// out once per pixel.
+func (s *Sorter) sortPixels(sc *scratch, px []color.NRGBA) {
+    n := len(px)
+    sc.keys = grow(sc.keys, n)
+    sc.workKeys = grow(sc.workKeys, n)
+    key := s.key
+    if key != nil {
+        for k := range px {
+            sc.keys[k] = key(&px[k])
+        }
+    }
+    work, keys, workKeys := sc.work[:n], sc.keys[:n], sc.workKeys[:n]
+    copy(work, px)
+    copy(workKeys, keys)
+
+    descend, crush := s.flags.DESCEND, s.flags.CRUSH
+    for width := 1; width < n; width = 2*width {
+        for i := 0; i < n; i = i + 2*width {
+            iLeft, iRight, iEnd := i, psmath.IntMin(i+width, n), psmath.IntMin(i+2*width, n)
+            a, b := iLeft, iRight
+            for k := iLeft; k < iEnd; k++ {
+                comp := false
+                if key != nil && a < n && b < n {
+                    if descend {
+                        comp = keys[a] > keys[b]
+                    } else {
+                        comp = keys[a] < keys[b]
+                    }
+                }
+                if a < iRight && (b >= iEnd || comp) {
+                    work[k], workKeys[k] = px[a], keys[a]
+                    a++
+                } else {
+                    if crush {
+                        work[a], workKeys[a] = px[b], keys[b]
+                    } else {
+                        work[k], workKeys[k] = px[b], keys[b]
+                    }
+                    b++
+                }
+            }
+        }
+        copy(px, work)
+        copy(keys, workKeys)
+    }
+}
+
+// contrastMask holds the parameters of the "contrast" mask generator, which
+// SortInto computes in place.
+type contrastMask struct {
+    threshold uint8
+    invert bool
+}
+
+// prepare resolves what SortInto needs from the options once, when the
+// sorter is built.
+func (s *Sorter) prepare() error {
+    s.flags = s.opts.Flags()
+    s.key = s.flags.KEY
+    if s.key == nil && s.flags.GRAY_RED_COMPARE {
+        s.key = func(c color.Color) float64 {
+            return float64(psmath.RedKey(c))
+        }
+    } else if s.key == nil && s.flags.MEAN_COMPARE {
+        s.key = func(c color.Color) float64 {
+            return float64(psmath.MeanKey(c))
+        }
+    }
+
+    gen, err := s.opts.maskFunc()
+    if err != nil {
+        return err
+    }
+    s.maskGen = gen
+    if s.opts.MaskGen == "" || s.opts.MaskGen == "contrast" {
+        entry, _ := registry.Masks.Lookup("contrast")
+        args, err := registry.Bind(entry.Params, s.opts.params())
+        if err != nil {
+            return err
+        }
+        s.contrast = &contrastMask{threshold: uint8(args.Int("threshold")), invert: args.Bool("invert")}
+    }
+    return nil
+}
+
+// intoState is the part of a Sorter that only SortInto uses.
+type intoState struct {
+    flags f.Flags
+    key registry.KeyFunc
+    maskGen registry.MaskFunc
+    contrast *contrastMask
+
+    scratch sync.Pool
+
+    fixedOnce sync.Once
+    fixedMask []bool
+    fixedSize image.Point
+    fixedErr error
+}
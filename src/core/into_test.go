@@ -0,0 +1,117 @@
+package core
+
+import (
+    "bytes"
+    "fmt"
+    "image"
+    "image/color"
+    "testing"
+
+    psmath "github.com/faceplate-kleo/pixelsorter/lib/math"
+)
+
+// testImage is a w by h image of gradients and noise, the same for the same
+// seed.
+func testImage(w, h int, seed int64) *image.NRGBA {
+    rng := psmath.NewRand(seed)
+    img := image.NewNRGBA(image.Rect(0, 0, w, h))
+    for y := 0; y < h; y++ {
+        for x := 0; x < w; x++ {
+            img.SetNRGBA(x, y, color.NRGBA{
+                uint8(x * 255 / w),
+                uint8(y * 255 / h),
+                uint8(rng.Intn(256)),
+                255,
+            })
+        }
+    }
+    return img
+}
+
+// testMask is a mask of diagonal white bands.
+func testMask(w, h int) *image.NRGBA {
+    mask := image.NewNRGBA(image.Rect(0, 0, w, h))
+    for y := 0; y < h; y++ {
+        for x := 0; x < w; x++ {
+            c := color.NRGBA{0, 0, 0, 255}
+            if (x+y)/7%3 != 0 {
+                c = color.NRGBA{255, 255, 255, 255}
+            }
+            mask.SetNRGBA(x, y, c)
+        }
+    }
+    return mask
+}
+
+func TestSortIntoMatchesSort(t *testing.T) {
+    img := testImage(61, 47, 1)
+    for _, direction := range []string{"right", "left", "up", "down"} {
+        for _, anchor := range []string{"start", "end", "center", "bidirectional", "fixed"} {
+            for _, masked := range []bool{false, true} {
+                name := fmt.Sprintf("%s/%s/mask=%v", direction, anchor, masked)
+                t.Run(name, func(t *testing.T) {
+                    opts := DefaultOptions()
+                    opts.Direction = direction
+                    opts.Anchor = anchor
+                    opts.NoiseFactor = 6
+                    opts.Seed = 42
+                    if masked {
+                        opts.Mask = testMask(61, 47)
+                    }
+                    sorter, err := NewSorter(opts)
+                    if err != nil {
+                        t.Fatal(err)
+                    }
+                    want, _, err := sorter.Sort(img)
+                    if err != nil {
+                        t.Fatal(err)
+                    }
+                    dst := image.NewNRGBA(img.Rect)
+                    //the second run reuses pooled scratch space
+                    for run := 0; run < 2; run++ {
+                        if err := sorter.SortInto(dst, img); err != nil {
+                            t.Fatal(err)
+                        }
+                        if !bytes.Equal(dst.Pix, want.Pix) {
+                            t.Fatalf("run %d: SortInto differs from Sort", run+1)
+                        }
+                    }
+                })
+            }
+        }
+    }
+}
+
+func benchmarkSorter(b *testing.B) (*Sorter, *image.NRGBA) {
+    opts := DefaultOptions()
+    opts.NoiseFactor = 8
+    opts.Seed = 1
+    sorter, err := NewSorter(opts)
+    if err != nil {
+        b.Fatal(err)
+    }
+    return sorter, testImage(512, 512, 1)
+}
+
+func BenchmarkSort(b *testing.B) {
+    sorter, img := benchmarkSorter(b)
+    b.ReportAllocs()
+    b.ResetTimer()
+    for i := 0; i < b.N; i++ {
+        if _, _, err := sorter.Sort(img); err != nil {
+            b.Fatal(err)
+        }
+    }
+}
+
+func BenchmarkSortInto(b *testing.B) {
+    sorter, img := benchmarkSorter(b)
+    dst := image.NewNRGBA(img.Rect)
+    b.ReportAllocs()
+    b.ResetTimer()
+    for i := 0; i < b.N; i++ {
+        if err := sorter.SortInto(dst, img); err != nil {
+            b.Fatal(err)
+        }
+    }
+}
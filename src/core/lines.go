@@ -0,0 +1,127 @@
+package core
+
+import (
+    "fmt"
+    "image"
+    "sort"
+    "strings"
+
+    "github.com/faceplate-kleo/pixelsorter/lib/masks"
+    psmath "github.com/faceplate-kleo/pixelsorter/lib/math"
+)
+
+var lineAggregates = []string{"mean", "median", "variance", "mask"}
+
+func ValidAggregate(aggregate string) bool {
+    for _, name := range lineAggregates {
+        if strings.ToLower(aggregate) == name {
+            return true
+        }
+    }
+    return false
+}
+
+// SortLines reorders whole rows ("rows" mode) or columns ("cols" mode)
+// relative to each other by an aggregate of their pixels. The pixels within a
+// line are not touched. Without a mask file, a precomputed mask or the "mask"
+// aggregate no mask is used, and the mask returned is nil.
+func SortLines(imData *image.NRGBA, mask *image.NRGBA, opts Options) (*image.NRGBA, *image.NRGBA, error) {
+    flags := opts.Flags()
+    bounds := imData.Bounds()
+    aggregate := strings.ToLower(opts.Aggregate)
+    if aggregate == "mask" || mask != nil || opts.MaskPath != "" {
+        var err error
+        if mask, err = BuildMask(imData, mask, opts); err != nil {
+            return nil, nil, err
+        }
+    }
+
+    columns := opts.Mode == "cols"
+    lines, length := bounds.Dy(), bounds.Dx()
+    if columns {
+        lines, length = length, lines
+    }
+    point := func(line, k int) (int, int) {
+        if columns {
+            return bounds.Min.X + line, bounds.Min.Y + k
+        }
+        return bounds.Min.X + k, bounds.Min.Y + line
+    }
+
+    keys := make([]float64, lines)
+    values := make([]float64, length)
+    for line := 0; line < lines; line++ {
+        for k := 0; k < length; k++ {
+            x, y := point(line, k)
+            if aggregate == "mask" {
+                values[k] = 0
+                if masks.ColorIsWhite(mask.At(x, y)) {
+                    values[k] = 1
+                }
+            } else {
+                values[k] = float64(psmath.ColorKey(imData.At(x, y), flags))
+            }
+        }
+        keys[line] = LineAggregate(values, aggregate)
+    }
+
+    order := make([]int, lines)
+    for i := range order {
+        order[i] = i
+    }
+    sort.SliceStable(order, func(a, b int) bool {
+        if flags.DESCEND {
+            return keys[order[a]] > keys[order[b]]
+        }
+        return keys[order[a]] < keys[order[b]]
+    })
+
+    output := image.NewNRGBA(bounds)
+    for line, from := range order {
+        for k := 0; k < length; k++ {
+            dx, dy := point(line, k)
+            sx, sy := point(from, k)
+            output.SetNRGBA(dx, dy, imData.NRGBAAt(sx, sy))
+        }
+    }
+
+    return output, mask, nil
+}
+
+// LineAggregate reduces the keys of one line to a single value. "mask"
+// counts the pixels that are set, which LineAggregate sees as 1s.
+func LineAggregate(values []float64, aggregate string) float64 {
+    if len(values) == 0 {
+        return 0
+    }
+    total := 0.0
+    for _, v := range values {
+        total += v
+    }
+    mean := total / float64(len(values))
+
+    switch aggregate {
+    case "mask":
+        return total
+    case "median":
+        sorted := make([]float64, len(values))
+        copy(sorted, values)
+        sort.Float64s(sorted)
+        mid := len(sorted) / 2
+        if len(sorted)%2 == 0 {
+            return (sorted[mid-1] + sorted[mid]) / 2
+        }
+        return sorted[mid]
+    case "variance":
+        variance := 0.0
+        for _, v := range values {
+            variance += (v - mean) * (v - mean)
+        }
+        return variance / float64(len(values))
+    }
+    return mean
+}
+
+func lineAggregateError(aggregate string) error {
+    return fmt.Errorf("unknown aggregate %q, expected one of %s", aggregate, strings.Join(lineAggregates, ", "))
+}
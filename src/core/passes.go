@@ -0,0 +1,219 @@
+package core
+
+import (
+    "fmt"
+    "image"
+    "strconv"
+    "strings"
+
+    psmath "github.com/faceplate-kleo/pixelsorter/lib/math"
+    "github.com/faceplate-kleo/pixelsorter/lib/nrgbautil"
+    "github.com/faceplate-kleo/pixelsorter/lib/registry"
+)
+
+// Pass holds the settings for one step of a multi-pass sort. The output of
+// each pass is fed to the next one in memory.
+type Pass struct {
+    Options
+    // RecomputeMask builds a fresh mask for this pass instead of reusing the
+    // mask of the previous pass.
+    RecomputeMask bool
+}
+
+// ParsePass reads a pass spec of the form "direction=down,threshold=80,invert".
+// Any setting missing from the spec is taken from base. Names that are not
+// settings but are declared as a param by a registered entry, such as
+// "length=40", go into Params.
+func ParsePass(spec string, base Pass) (Pass, error) {
+    pass := base
+    for _, field := range strings.Split(spec, ",") {
+        field = strings.TrimSpace(field)
+        if field == "" {
+            continue
+        }
+        key, value, hasValue := strings.Cut(field, "=")
+        key = strings.ToLower(strings.TrimSpace(key))
+        value = strings.TrimSpace(value)
+
+        var err error
+        switch key {
+        case "direction", "dir":
+            pass.Direction = strings.ToLower(value)
+            if !ValidDirection(pass.Direction) {
+                err = fmt.Errorf("unknown direction %q", value)
+            }
+        case "key":
+            pass.Key = strings.ToLower(value)
+            if !registry.Keys.Has(pass.Key) {
+                err = registry.Keys.UnknownError(value)
+            }
+        case "mask_gen":
+            pass.MaskGen = strings.ToLower(value)
+            if !registry.Masks.Has(pass.MaskGen) {
+                err = registry.Masks.UnknownError(value)
+            }
+        case "span_op":
+            pass.SpanOp = strings.ToLower(value)
+            if !registry.SpanOps.Has(pass.SpanOp) {
+                err = registry.SpanOps.UnknownError(value)
+            }
+        case "threshold":
+            pass.Threshold, err = strconv.Atoi(value)
+        case "scalar":
+            pass.Scalar, err = strconv.ParseFloat(value, 64)
+        case "noise":
+            pass.NoiseFactor, err = strconv.Atoi(value)
+        case "seed":
+            pass.Seed, err = strconv.ParseInt(value, 10, 64)
+        case "mask":
+            pass.MaskPath = value
+        case "invert":
+            pass.Invert, err = parsePassBool(value, hasValue)
+        case "clean":
+            pass.Clean, err = parsePassBool(value, hasValue)
+        case "descend":
+            pass.Descend, err = parsePassBool(value, hasValue)
+        case "anchor":
+            pass.Anchor = strings.ToLower(value)
+            if !ValidAnchor(pass.Anchor) {
+                err = registry.Intervals.UnknownError(value)
+            }
+        case "scan":
+            pass.Scan = strings.ToLower(value)
+            if !ValidScan(pass.Scan) {
+                err = fmt.Errorf("unknown scan order %q", value)
+            }
+        case "mode":
+            pass.Mode = strings.ToLower(value)
+            if !ValidMode(pass.Mode) {
+                err = fmt.Errorf("unknown mode %q", value)
+            }
+        case "aggregate":
+            pass.Aggregate = strings.ToLower(value)
+            if !ValidAggregate(pass.Aggregate) {
+                err = lineAggregateError(value)
+            }
+        case "tile_op":
+            pass.TileOp = strings.ToLower(value)
+            if pass.TileOp != "sort" && pass.TileOp != "arrange" {
+                err = fmt.Errorf("unknown tile op %q", value)
+            }
+        case "tiles":
+            pass.Grid, err = ParseSize(value)
+        case "block":
+            pass.Block, err = ParseSize(value)
+        case "region":
+            pass.Region, err = ParseRegion(value)
+        case "remask":
+            pass.RecomputeMask, err = parsePassBool(value, hasValue)
+        case "keep_mask":
+            var keep bool
+            keep, err = parsePassBool(value, hasValue)
+            pass.RecomputeMask = !keep
+        default:
+            if !registry.DeclaresParam(key) {
+                err = fmt.Errorf("unknown setting")
+                break
+            }
+            //params of registered entries, copied so base is left alone
+            params := make(map[string]string, len(pass.Params)+1)
+            for name, v := range pass.Params {
+                params[name] = v
+            }
+            params[key] = value
+            pass.Params = params
+        }
+        if err != nil {
+            return pass, fmt.Errorf("pass %q: %s: %w", spec, key, err)
+        }
+    }
+    return pass, nil
+}
+
+func parsePassBool(value string, hasValue bool) (bool, error) {
+    if !hasValue {
+        return true, nil
+    }
+    return strconv.ParseBool(value)
+}
+
+// ValidAnchor reports whether anchor names a registered interval. The empty
+// anchor means "start".
+func ValidAnchor(anchor string) bool {
+    return anchor == "" || registry.Intervals.Has(anchor)
+}
+
+func ValidMode(mode string) bool {
+    switch strings.ToLower(mode) {
+    case "span", "tiles", "rows", "cols", "regions":
+        return true
+    }
+    return false
+}
+
+func ValidDirection(direction string) bool {
+    switch strings.ToLower(direction) {
+    case "up", "down", "left", "right":
+        return true
+    }
+    return false
+}
+
+// OrientNrgba turns an image so that a sort in the given direction becomes a
+// left-to-right sort. RestoreNrgba undoes it.
+func OrientNrgba(imData *image.NRGBA, direction string) *image.NRGBA {
+    switch strings.ToLower(direction) {
+    case "up":
+        return nrgbautil.RotateNrgba(imData, 1)
+    case "down":
+        return nrgbautil.RotateNrgba(imData, 3)
+    case "left":
+        return nrgbautil.FlipNrgba(imData, true)
+    }
+    return imData
+}
+
+func RestoreNrgba(imData *image.NRGBA, direction string) *image.NRGBA {
+    switch strings.ToLower(direction) {
+    case "up":
+        return nrgbautil.RotateNrgba(imData, 3)
+    case "down":
+        return nrgbautil.RotateNrgba(imData, 1)
+    case "left":
+        return nrgbautil.FlipNrgba(imData, true)
+    }
+    return imData
+}
+
+// SortPasses runs each pass in order over the image. Unless a pass asks for
+// its mask to be recomputed, the mask of the previous pass is reused. The
+// returned mask is the last one used, in image orientation, and nil if the
+// last pass used none.
+func SortPasses(imData *image.NRGBA, passes []Pass) (*image.NRGBA, *image.NRGBA, error) {
+    var mask *image.NRGBA
+    for i := range passes {
+        sorter, err := NewSorter(passOptions(passes, i, mask))
+        if err != nil {
+            return nil, nil, fmt.Errorf("pass %d: %w", i+1, err)
+        }
+        imData, mask, err = sorter.Sort(imData)
+        if err != nil {
+            return nil, nil, fmt.Errorf("pass %d: %w", i+1, err)
+        }
+    }
+    return imData, mask, nil
+}
+
+// passOptions are the options pass i runs with, given the mask the pass
+// before it used. A pass after one that used no mask builds its own.
+func passOptions(passes []Pass, i int, mask *image.NRGBA) Options {
+    opts := passes[i].Options
+    if i > 0 && !passes[i].RecomputeMask && mask != nil {
+        opts.Mask = mask
+    }
+    if i > 0 && opts.Seed != 0 && opts.Seed == passes[i-1].Seed {
+        //keep the noise of consecutive passes from lining up
+        opts.Seed = psmath.SubSeed(opts.Seed, int64(i))
+    }
+    return opts
+}
@@ -0,0 +1,168 @@
+package core
+
+import (
+    "errors"
+    "fmt"
+    "image"
+    "io"
+    "runtime"
+    "sort"
+    "time"
+
+    "github.com/faceplate-kleo/pixelsorter/lib/nrgbautil"
+)
+
+// PassStats is what PlanPasses measured of one pass.
+type PassStats struct {
+    Mode string
+    // Pixels is the size of the masked area, MaskPixels how many of them
+    // the mask selects for sorting.
+    Pixels int
+    MaskPixels int
+    // Masked is false for passes that used no mask, such as rows and cols
+    // without one.
+    Masked bool
+    // Spans are the lengths of the spans sorted, clipped to the image. Only
+    // span mode without a region has them.
+    Spans []int
+    Elapsed time.Duration
+    // Allocated is how many bytes the sort allocated.
+    Allocated uint64
+}
+
+// PlanPasses runs the passes like SortPasses does and reports on each of
+// them. Span lengths are found with an extra run over the pass's input,
+// which is not part of Elapsed.
+func PlanPasses(imData *image.NRGBA, passes []Pass) ([]PassStats, *image.NRGBA, error) {
+    stats := make([]PassStats, 0, len(passes))
+    var mask *image.NRGBA
+    for i := range passes {
+        sorter, err := NewSorter(passOptions(passes, i, mask))
+        if err != nil {
+            return nil, nil, fmt.Errorf("pass %d: %w", i+1, err)
+        }
+        spans, err := sorter.SpanLengths(imData)
+        if err != nil {
+            return nil, nil, fmt.Errorf("pass %d: %w", i+1, err)
+        }
+
+        var before, after runtime.MemStats
+        runtime.ReadMemStats(&before)
+        began := time.Now()
+        imData, mask, err = sorter.Sort(imData)
+        elapsed := time.Since(began)
+        runtime.ReadMemStats(&after)
+        if err != nil {
+            return nil, nil, fmt.Errorf("pass %d: %w", i+1, err)
+        }
+
+        stats = append(stats, PassStats{
+            Mode: sorter.opts.Mode,
+            Pixels: imData.Rect.Dx() * imData.Rect.Dy(),
+            MaskPixels: maskCoverage(mask),
+            Masked: mask != nil,
+            Spans: spans,
+            Elapsed: elapsed,
+            Allocated: after.TotalAlloc - before.TotalAlloc,
+        })
+    }
+    return stats, imData, nil
+}
+
+// PlanWaveFrame renders one frame of WaveAnimation and reports on it like
+// PlanPasses does. The frame is the one of median loudness, so that its time
+// stands for the average frame. It also returns the frame and its index.
+func PlanWaveFrame(img image.Image, wav io.Reader, opts Options, framerate, num_buckets int) (PassStats, *image.NRGBA, int, error) {
+    render, err := newWaveRender(img, wav, opts, framerate, num_buckets)
+    if err != nil {
+        return PassStats{}, nil, 0, err
+    }
+    if render.numFrames == 0 {
+        return PassStats{}, nil, 0, errors.New("the audio is too short for a single frame")
+    }
+    order := make([]int, render.numFrames)
+    loudness := make([]int, render.numFrames)
+    for frame := range order {
+        order[frame] = frame
+        for _, amplitude := range render.waveStack[frame] {
+            loudness[frame] += amplitude
+        }
+    }
+    sort.SliceStable(order, func(a, b int) bool {
+        return loudness[order[a]] < loudness[order[b]]
+    })
+    frame := order[len(order)/2]
+
+    frameOpts := render.frameOptions(frame)
+    frameOpts.Mode = "span"
+    frameOpts.Mask = RestoreNrgba(render.mask, frameOpts.Direction)
+    sorter, err := NewSorter(frameOpts)
+    if err != nil {
+        return PassStats{}, nil, 0, err
+    }
+    spans, err := sorter.SpanLengths(render.imData)
+    if err != nil {
+        return PassStats{}, nil, 0, err
+    }
+
+    var before, after runtime.MemStats
+    runtime.ReadMemStats(&before)
+    began := time.Now()
+    sorted, err := render.sortFrame(frame)
+    elapsed := time.Since(began)
+    runtime.ReadMemStats(&after)
+    if err != nil {
+        return PassStats{}, nil, 0, err
+    }
+    return PassStats{
+        Mode: "span",
+        Pixels: render.mask.Rect.Dx() * render.mask.Rect.Dy(),
+        MaskPixels: maskCoverage(render.mask),
+        Masked: true,
+        Spans: spans,
+        Elapsed: elapsed,
+        Allocated: after.TotalAlloc - before.TotalAlloc,
+    }, sorted, frame, nil
+}
+
+// SpanLengths returns the length of every span Sort would sort in img, line
+// by line. Modes other than span, and sorts limited to a region, have no
+// spans of their own and give nil.
+func (s *Sorter) SpanLengths(img image.Image) ([]int, error) {
+    if img == nil {
+        return nil, errors.New("no image to measure")
+    }
+    if s.opts.Mode != "span" || !s.opts.Region.Empty() {
+        return nil, nil
+    }
+    src := nrgbautil.ToNrgba(img)
+    size := src.Rect.Size()
+    sc := newScratch(s.flags)
+    spans := []int{}
+    sc.onSpan = func(length int) {
+        spans = append(spans, length)
+    }
+    mask, err := s.intoMask(src, sc)
+    if err != nil {
+        return nil, err
+    }
+    s.sortSpansInto(image.NewNRGBA(image.Rectangle{Max: size}), src, mask, size, sc)
+    return spans, nil
+}
+
+// maskCoverage counts the pixels of mask that are sorted.
+func maskCoverage(mask *image.NRGBA) int {
+    if mask == nil {
+        return 0
+    }
+    size := mask.Rect.Size()
+    bools := make([]bool, size.X*size.Y)
+    maskToBools(bools, mask)
+    count := 0
+    for _, white := range bools {
+        if white {
+            count++
+        }
+    }
+    return count
+}
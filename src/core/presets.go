@@ -0,0 +1,164 @@
+package core
+
+import (
+    "embed"
+    "errors"
+    "fmt"
+    "io/fs"
+    "os"
+    "path/filepath"
+    "regexp"
+    "sort"
+    "strings"
+
+    pserrors "github.com/faceplate-kleo/pixelsorter/lib/errors"
+)
+
+// Presets are recipes without an input or output, kept under a name. The
+// built-in presets ship with the binary; user presets live in PresetDir and
+// take priority over built-ins of the same name.
+
+//go:embed presets/*.json
+var builtinPresets embed.FS
+
+var presetName = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// PresetInfo describes one available preset.
+type PresetInfo struct {
+    Name string
+    Description string
+    Builtin bool
+    // Path is the file of a user preset.
+    Path string
+}
+
+// PresetDir is the directory user presets are saved to: pixelsorter/presets
+// under the user config directory, e.g. ~/.config/pixelsorter/presets.
+func PresetDir() (string, error) {
+    config, err := os.UserConfigDir()
+    if err != nil {
+        return "", pserrors.IO("find config dir", "", err)
+    }
+    return filepath.Join(config, "pixelsorter", "presets"), nil
+}
+
+// PresetPath is the file a user preset of the given name is saved to. Names
+// are not case sensitive.
+func PresetPath(name string) (string, error) {
+    name = strings.ToLower(name)
+    if !presetName.MatchString(name) {
+        return "", fmt.Errorf("%w: preset name %q, use lowercase letters, digits, - and _", pserrors.ErrInvalidOptions, name)
+    }
+    dir, err := PresetDir()
+    if err != nil {
+        return "", err
+    }
+    return filepath.Join(dir, name+".json"), nil
+}
+
+// LoadPreset returns the named preset, a user preset if there is one and a
+// built-in preset otherwise.
+func LoadPreset(name string) (*Recipe, error) {
+    path, err := PresetPath(name)
+    if errors.Is(err, pserrors.ErrInvalidOptions) {
+        return nil, err
+    }
+    if err == nil {
+        recipe, err := LoadRecipe(path)
+        if !errors.Is(err, fs.ErrNotExist) {
+            return recipe, err
+        }
+    }
+    return LoadBuiltinPreset(name)
+}
+
+// SavePreset saves the passes and description of a recipe as a user preset,
+// replacing any user preset of the same name, and returns its path. The seed
+// is kept only when keepSeed is set.
+func SavePreset(name string, recipe *Recipe, keepSeed bool) (string, error) {
+    path, err := PresetPath(name)
+    if err != nil {
+        return "", err
+    }
+    dir := filepath.Dir(path)
+    if err := os.MkdirAll(dir, 0o755); err != nil {
+        return "", pserrors.IO("mkdir", dir, err)
+    }
+
+    preset := &Recipe{Version: RecipeVersion, Description: recipe.Description, Passes: recipe.Passes}
+    if keepSeed {
+        preset.Seed = recipe.Seed
+    }
+    file, err := os.Create(path)
+    if err != nil {
+        return "", pserrors.IO("create", path, err)
+    }
+    if err := preset.Encode(file); err != nil {
+        file.Close()
+        return "", err
+    }
+    if err := file.Close(); err != nil {
+        return "", pserrors.IO("close", path, err)
+    }
+    return path, nil
+}
+
+// ListPresets returns every available preset by name. A user preset that
+// shadows a built-in one is listed once, as the user preset. User presets
+// that fail to load are still listed, with the error as the description.
+func ListPresets() ([]PresetInfo, error) {
+    found := map[string]PresetInfo{}
+    for _, name := range presetNames() {
+        recipe, err := LoadBuiltinPreset(name)
+        if err != nil {
+            return nil, err
+        }
+        found[name] = PresetInfo{Name: name, Description: recipe.Description, Builtin: true}
+    }
+    if dir, err := PresetDir(); err == nil {
+        paths, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+        for _, path := range paths {
+            name := strings.TrimSuffix(filepath.Base(path), ".json")
+            info := PresetInfo{Name: name, Path: path}
+            if recipe, err := LoadRecipe(path); err != nil {
+                info.Description = err.Error()
+            } else {
+                info.Description = recipe.Description
+            }
+            found[name] = info
+        }
+    }
+
+    presets := make([]PresetInfo, 0, len(found))
+    for _, info := range found {
+        presets = append(presets, info)
+    }
+    sort.Slice(presets, func(i, j int) bool {
+        return presets[i].Name < presets[j].Name
+    })
+    return presets, nil
+}
+
+// LoadBuiltinPreset returns a built-in preset, ignoring user presets.
+func LoadBuiltinPreset(name string) (*Recipe, error) {
+    file, err := builtinPresets.Open("presets/" + strings.ToLower(name) + ".json")
+    if err != nil {
+        return nil, fmt.Errorf("%w: unknown preset %q, expected one of %s", pserrors.ErrInvalidOptions, name, strings.Join(presetNames(), ", "))
+    }
+    defer file.Close()
+    recipe, err := DecodeRecipe(file)
+    if err != nil {
+        return nil, fmt.Errorf("preset %s: %w", name, err)
+    }
+    return recipe, nil
+}
+
+// presetNames lists the built-in presets.
+func presetNames() []string {
+    entries, _ := builtinPresets.ReadDir("presets")
+    names := make([]string, 0, len(entries))
+    for _, entry := range entries {
+        names = append(names, strings.TrimSuffix(entry.Name(), ".json"))
+    }
+    return names
+}
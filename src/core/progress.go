@@ -0,0 +1,23 @@
+package core
+
+import (
+    "time"
+)
+
+// Progress is reported by long renders after every finished frame.
+type Progress struct {
+    Done int
+    Total int
+    Elapsed time.Duration
+}
+
+// Remaining estimates the time left from the average time per frame so far.
+func (p Progress) Remaining() time.Duration {
+    if p.Done == 0 || p.Total <= p.Done {
+        return 0
+    }
+    return p.Elapsed / time.Duration(p.Done) * time.Duration(p.Total-p.Done)
+}
+
+// ProgressFunc receives progress reports. Calls are never made concurrently.
+type ProgressFunc func(Progress)
@@ -0,0 +1,338 @@
+package core
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "image"
+    "io"
+    "os"
+    "strings"
+
+    "github.com/faceplate-kleo/pixelsorter/lib/anim"
+    pserrors "github.com/faceplate-kleo/pixelsorter/lib/errors"
+    "github.com/faceplate-kleo/pixelsorter/lib/nrgbautil"
+)
+
+// RecipeVersion is the recipe schema version this build reads and writes.
+const RecipeVersion = 1
+
+// Recipe is everything needed to reproduce a render, in a form that can be
+// saved as JSON. Paths are used as given, relative to the working directory.
+// Fields left out of a recipe file take the same defaults as the CLI flags.
+type Recipe struct {
+    Version int `json:"version"`
+    Description string `json:"description,omitempty"`
+    Input string `json:"input,omitempty"`
+    Output string `json:"output,omitempty"`
+    MaskOutput string `json:"mask_output,omitempty"`
+    // Format is the image format of Output and MaskOutput, one of
+    // nrgbautil.Formats. Empty means png.
+    Format string `json:"format,omitempty"`
+    // Seed is used by every pass that does not set a seed of its own.
+    Seed int64 `json:"seed"`
+    SourceDebug bool `json:"source_debug,omitempty"`
+    Passes []RecipePass `json:"passes"`
+    // Animation, when set, renders an animation from the first pass instead
+    // of a still image.
+    Animation *RecipeAnimation `json:"animation,omitempty"`
+}
+
+// RecipePass is one pass of a recipe. Sizes are written "WxH" and regions
+// "x,y,w,h", as on the command line.
+type RecipePass struct {
+    Mode string `json:"mode"`
+    Direction string `json:"direction"`
+    Key string `json:"key"`
+    Descend bool `json:"descend,omitempty"`
+    Crush bool `json:"crush,omitempty"`
+    Region string `json:"region,omitempty"`
+    Mask RecipeMask `json:"mask"`
+    Interval RecipeInterval `json:"interval"`
+    SpanOp string `json:"span_op"`
+    TileOp string `json:"tile_op,omitempty"`
+    Tiles string `json:"tiles,omitempty"`
+    Block string `json:"block,omitempty"`
+    Aggregate string `json:"aggregate,omitempty"`
+    Scan string `json:"scan,omitempty"`
+    Params map[string]string `json:"params,omitempty"`
+    Seed int64 `json:"seed,omitempty"`
+    DebugSpans bool `json:"debug_spans,omitempty"`
+    DebugMask bool `json:"debug_mask,omitempty"`
+}
+
+// RecipeMask is the mask pipeline of a pass: a mask file, the mask of the
+// previous pass, or a registered generator.
+type RecipeMask struct {
+    Path string `json:"path,omitempty"`
+    KeepPrevious bool `json:"keep_previous,omitempty"`
+    Generator string `json:"generator"`
+    Threshold int `json:"threshold"`
+    Invert bool `json:"invert,omitempty"`
+}
+
+// RecipeInterval is how spans are sized and placed on mask runs.
+type RecipeInterval struct {
+    Anchor string `json:"anchor"`
+    Scalar float64 `json:"scalar"`
+    Noise int `json:"noise"`
+    Clean bool `json:"clean,omitempty"`
+}
+
+type RecipeAnimation struct {
+    // Frames is the frame count when there is no audio.
+    Frames int `json:"frames"`
+    Format string `json:"format"`
+    Output string `json:"output,omitempty"`
+    Audio *RecipeAudio `json:"audio,omitempty"`
+}
+
+// RecipeAudio maps a .wav file onto the span lengths of each frame.
+type RecipeAudio struct {
+    Wav string `json:"wav"`
+    Framerate int `json:"framerate"`
+    Buckets int `json:"buckets"`
+}
+
+// NewRecipe returns a recipe for the given passes, with the seed of the first
+// pass as the recipe seed.
+func NewRecipe(passes ...Pass) *Recipe {
+    recipe := &Recipe{Version: RecipeVersion}
+    if len(passes) > 0 {
+        recipe.Seed = passes[0].Seed
+    }
+    for _, pass := range passes {
+        recipePass := RecipePassFrom(pass)
+        if recipePass.Seed == recipe.Seed {
+            recipePass.Seed = 0
+        }
+        recipe.Passes = append(recipe.Passes, recipePass)
+    }
+    return recipe
+}
+
+// RecipePassFrom describes a pass. An in-memory Options.Mask and the Signal
+// can not be saved and are left out.
+func RecipePassFrom(pass Pass) RecipePass {
+    opts := pass.Options
+    recipePass := RecipePass{
+        Mode: opts.Mode,
+        Direction: opts.Direction,
+        Key: opts.Key,
+        Descend: opts.Descend,
+        Crush: opts.Crush,
+        Mask: RecipeMask{
+            Path: opts.MaskPath,
+            KeepPrevious: !pass.RecomputeMask,
+            Generator: opts.MaskGen,
+            Threshold: opts.Threshold,
+            Invert: opts.Invert,
+        },
+        Interval: RecipeInterval{
+            Anchor: opts.Anchor,
+            Scalar: opts.Scalar,
+            Noise: opts.NoiseFactor,
+            Clean: opts.Clean,
+        },
+        SpanOp: opts.SpanOp,
+        TileOp: opts.TileOp,
+        Aggregate: opts.Aggregate,
+        Scan: opts.Scan,
+        Params: opts.Params,
+        Seed: opts.Seed,
+        DebugSpans: opts.DebugSpans,
+        DebugMask: opts.DebugMask,
+    }
+    if opts.Grid != (image.Point{}) {
+        recipePass.Tiles = fmt.Sprintf("%dx%d", opts.Grid.X, opts.Grid.Y)
+    }
+    if opts.Block != (image.Point{}) {
+        recipePass.Block = fmt.Sprintf("%dx%d", opts.Block.X, opts.Block.Y)
+    }
+    if !opts.Region.Empty() {
+        r := opts.Region
+        recipePass.Region = fmt.Sprintf("%d,%d,%d,%d", r.Min.X, r.Min.Y, r.Dx(), r.Dy())
+    }
+    if len(recipePass.Params) == 0 {
+        recipePass.Params = nil
+    }
+    return recipePass
+}
+
+// Pass turns the recipe pass back into a Pass. seed is used when the pass
+// has no seed of its own.
+func (p RecipePass) Pass(seed int64) (Pass, error) {
+    opts := Options{
+        Direction: p.Direction,
+        Key: p.Key,
+        Descend: p.Descend,
+        Crush: p.Crush,
+        Threshold: p.Mask.Threshold,
+        Invert: p.Mask.Invert,
+        MaskPath: p.Mask.Path,
+        MaskGen: p.Mask.Generator,
+        Scalar: p.Interval.Scalar,
+        NoiseFactor: p.Interval.Noise,
+        Clean: p.Interval.Clean,
+        Anchor: p.Interval.Anchor,
+        SpanOp: p.SpanOp,
+        Params: p.Params,
+        Mode: p.Mode,
+        TileOp: p.TileOp,
+        Aggregate: p.Aggregate,
+        Scan: p.Scan,
+        Seed: p.Seed,
+        DebugSpans: p.DebugSpans,
+        DebugMask: p.DebugMask,
+    }
+    if opts.Seed == 0 {
+        opts.Seed = seed
+    }
+    var err error
+    if p.Tiles != "" {
+        if opts.Grid, err = ParseSize(p.Tiles); err != nil {
+            return Pass{}, fmt.Errorf("tiles: %w", err)
+        }
+    }
+    if p.Block != "" {
+        if opts.Block, err = ParseSize(p.Block); err != nil {
+            return Pass{}, fmt.Errorf("block: %w", err)
+        }
+    }
+    if p.Region != "" {
+        if opts.Region, err = ParseRegion(p.Region); err != nil {
+            return Pass{}, fmt.Errorf("region: %w", err)
+        }
+    }
+    return Pass{Options: opts, RecomputeMask: !p.Mask.KeepPrevious}, nil
+}
+
+// ToPasses returns the passes of the recipe as Pass values, checking each
+// of them.
+func (r *Recipe) ToPasses() ([]Pass, error) {
+    passes := make([]Pass, len(r.Passes))
+    for i, recipePass := range r.Passes {
+        pass, err := recipePass.Pass(r.Seed)
+        if err != nil {
+            return nil, fmt.Errorf("%w: recipe pass %d: %v", pserrors.ErrInvalidOptions, i+1, err)
+        }
+        if err := pass.Validate(); err != nil {
+            return nil, fmt.Errorf("recipe pass %d: %w", i+1, err)
+        }
+        passes[i] = pass
+    }
+    return passes, nil
+}
+
+// Validate checks the whole recipe without rendering anything.
+func (r *Recipe) Validate() error {
+    problems := []string{}
+    if r.Version != RecipeVersion {
+        problems = append(problems, fmt.Sprintf("unsupported version %d, expected %d", r.Version, RecipeVersion))
+    }
+    if len(r.Passes) == 0 {
+        problems = append(problems, "no passes")
+    }
+    if !nrgbautil.KnownFormat(r.Format) {
+        problems = append(problems, fmt.Sprintf("unknown image format %q, expected one of %s", r.Format, strings.Join(nrgbautil.Formats, ", ")))
+    }
+    if animation := r.Animation; animation != nil {
+        known := false
+        for _, format := range anim.Formats {
+            known = known || strings.EqualFold(format, animation.Format)
+        }
+        if !known {
+            problems = append(problems, fmt.Sprintf("unknown animation format %q, expected one of %s", animation.Format, strings.Join(anim.Formats, ", ")))
+        }
+        if animation.Audio == nil && animation.Frames <= 0 {
+            problems = append(problems, fmt.Sprintf("animation needs at least one frame, got %d", animation.Frames))
+        }
+        if audio := animation.Audio; audio != nil {
+            if audio.Wav == "" {
+                problems = append(problems, "audio has no wav file")
+            }
+            if audio.Framerate <= 0 || audio.Buckets <= 0 {
+                problems = append(problems, fmt.Sprintf("audio framerate %d and buckets %d must be positive", audio.Framerate, audio.Buckets))
+            }
+        }
+    }
+    if len(problems) > 0 {
+        return fmt.Errorf("%w: recipe: %s", pserrors.ErrInvalidOptions, strings.Join(problems, "; "))
+    }
+    _, err := r.ToPasses()
+    return err
+}
+
+// DecodeRecipe reads a JSON recipe and validates it. Unknown fields are
+// rejected, so that typos do not go unnoticed.
+func DecodeRecipe(rd io.Reader) (*Recipe, error) {
+    recipe := &Recipe{}
+    if err := decodeStrict(rd, recipe); err != nil {
+        return nil, fmt.Errorf("%w: recipe: %v", pserrors.ErrInvalidOptions, err)
+    }
+    if err := recipe.Validate(); err != nil {
+        return nil, err
+    }
+    return recipe, nil
+}
+
+func LoadRecipe(path string) (*Recipe, error) {
+    file, err := os.Open(path)
+    if err != nil {
+        return nil, pserrors.IO("open", path, err)
+    }
+    defer file.Close()
+
+    recipe, err := DecodeRecipe(file)
+    if err != nil {
+        return nil, fmt.Errorf("%s: %w", path, err)
+    }
+    return recipe, nil
+}
+
+// Encode writes the recipe as indented JSON.
+func (r *Recipe) Encode(w io.Writer) error {
+    encoder := json.NewEncoder(w)
+    encoder.SetIndent("", "  ")
+    if err := encoder.Encode(r); err != nil {
+        return pserrors.IO("encode recipe", "", err)
+    }
+    return nil
+}
+
+func decodeStrict(rd io.Reader, v any) error {
+    decoder := json.NewDecoder(rd)
+    decoder.DisallowUnknownFields()
+    return decoder.Decode(v)
+}
+
+// UnmarshalJSON fills in the defaults for anything the pass leaves out.
+func (p *RecipePass) UnmarshalJSON(data []byte) error {
+    type plain RecipePass
+    pass := plain(RecipePassFrom(Pass{Options: DefaultOptions(), RecomputeMask: true}))
+    if err := decodeStrict(bytes.NewReader(data), &pass); err != nil {
+        return err
+    }
+    *p = RecipePass(pass)
+    return nil
+}
+
+func (a *RecipeAnimation) UnmarshalJSON(data []byte) error {
+    type plain RecipeAnimation
+    animation := plain{Frames: 10, Format: "gif"}
+    if err := decodeStrict(bytes.NewReader(data), &animation); err != nil {
+        return err
+    }
+    *a = RecipeAnimation(animation)
+    return nil
+}
+
+func (a *RecipeAudio) UnmarshalJSON(data []byte) error {
+    type plain RecipeAudio
+    audio := plain{Framerate: 25, Buckets: 128}
+    if err := decodeStrict(bytes.NewReader(data), &audio); err != nil {
+        return err
+    }
+    *a = RecipeAudio(audio)
+    return nil
+}
@@ -0,0 +1,90 @@
+package core
+
+import (
+    "bytes"
+    "errors"
+    "image"
+    "reflect"
+    "strings"
+    "testing"
+
+    pserrors "github.com/faceplate-kleo/pixelsorter/lib/errors"
+)
+
+func TestRecipeRoundTrip(t *testing.T) {
+    first := DefaultOptions()
+    first.Seed = 42
+    first.Anchor = "fixed"
+    first.Params = map[string]string{"length": "20"}
+    first.NoiseFactor = -6
+    first.Region = image.Rect(4, 6, 36, 26)
+    first.MaskPath = "mask.png"
+    first.Invert = true
+    second := DefaultOptions()
+    second.Seed = 7
+    second.Mode = "tiles"
+    second.Grid = image.Pt(4, 3)
+    second.Direction = "down"
+    second.Descend = true
+    second.Key = "hue"
+    passes := []Pass{{Options: first, RecomputeMask: true}, {Options: second}}
+
+    var encoded bytes.Buffer
+    if err := NewRecipe(passes...).Encode(&encoded); err != nil {
+        t.Fatal(err)
+    }
+    recipe, err := DecodeRecipe(&encoded)
+    if err != nil {
+        t.Fatal(err)
+    }
+    decoded, err := recipe.ToPasses()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !reflect.DeepEqual(decoded, passes) {
+        t.Fatalf("round trip changed the passes:\n got %+v\nwant %+v", decoded, passes)
+    }
+}
+
+func TestRecipeDefaults(t *testing.T) {
+    recipe, err := DecodeRecipe(strings.NewReader(`{
+        "version": 1,
+        "seed": 5,
+        "passes": [{"direction": "down"}],
+        "animation": {"audio": {"wav": "song.wav"}}
+    }`))
+    if err != nil {
+        t.Fatal(err)
+    }
+    passes, err := recipe.ToPasses()
+    if err != nil {
+        t.Fatal(err)
+    }
+    want := DefaultOptions()
+    want.Direction = "down"
+    want.Seed = 5
+    if !reflect.DeepEqual(passes, []Pass{{Options: want, RecomputeMask: true}}) {
+        t.Fatalf("omitted fields not defaulted: %+v", passes[0])
+    }
+    animation := recipe.Animation
+    if animation.Frames != 10 || animation.Format != "gif" || animation.Audio.Framerate != 25 || animation.Audio.Buckets != 128 {
+        t.Fatalf("animation not defaulted: %+v, audio %+v", animation, animation.Audio)
+    }
+}
+
+func TestRecipeRejectsUnknownFields(t *testing.T) {
+    recipes := map[string]string{
+        "recipe": `{"version": 1, "passes": [{}], "sead": 5}`,
+        "pass": `{"version": 1, "passes": [{"direciton": "down"}]}`,
+        "mask": `{"version": 1, "passes": [{"mask": {"treshold": 90}}]}`,
+        "interval": `{"version": 1, "passes": [{"interval": {"nosie": 3}}]}`,
+        "animation": `{"version": 1, "passes": [{}], "animation": {"frame": 3}}`,
+        "audio": `{"version": 1, "passes": [{}], "animation": {"audio": {"wav": "a.wav", "fps": 30}}}`,
+    }
+    for name, recipe := range recipes {
+        _, err := DecodeRecipe(strings.NewReader(recipe))
+        if !errors.Is(err, pserrors.ErrInvalidOptions) || !strings.Contains(err.Error(), "unknown field") {
+            t.Errorf("%s: got %v, want an unknown field error", name, err)
+        }
+    }
+}
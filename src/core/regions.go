@@ -0,0 +1,130 @@
+package core
+
+import (
+    "image"
+    "image/color"
+    "image/draw"
+    "sort"
+    "strings"
+
+    "github.com/faceplate-kleo/pixelsorter/lib/masks"
+    psmath "github.com/faceplate-kleo/pixelsorter/lib/math"
+)
+
+func ValidScan(scan string) bool {
+    switch strings.ToLower(scan) {
+    case "", "row", "col", "radial":
+        return true
+    }
+    return false
+}
+
+// MaskRegions finds the 4-connected regions of white pixels in the mask.
+func MaskRegions(mask *image.NRGBA) [][]image.Point {
+    bounds := mask.Bounds()
+    width := bounds.Dx()
+    seen := make([]bool, width*bounds.Dy())
+    regions := [][]image.Point{}
+
+    for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+        for x := bounds.Min.X; x < bounds.Max.X; x++ {
+            index := (y-bounds.Min.Y)*width + (x - bounds.Min.X)
+            if seen[index] || !masks.ColorIsWhite(mask.At(x, y)) {
+                continue
+            }
+            seen[index] = true
+
+            region := []image.Point{}
+            stack := []image.Point{{x, y}}
+            for len(stack) > 0 {
+                p := stack[len(stack)-1]
+                stack = stack[:len(stack)-1]
+                region = append(region, p)
+
+                for _, n := range [4]image.Point{{p.X+1, p.Y}, {p.X-1, p.Y}, {p.X, p.Y+1}, {p.X, p.Y-1}} {
+                    if !n.In(bounds) {
+                        continue
+                    }
+                    n_index := (n.Y-bounds.Min.Y)*width + (n.X - bounds.Min.X)
+                    if seen[n_index] || !masks.ColorIsWhite(mask.At(n.X, n.Y)) {
+                        continue
+                    }
+                    seen[n_index] = true
+                    stack = append(stack, n)
+                }
+            }
+            regions = append(regions, region)
+        }
+    }
+    return regions
+}
+
+// ScanOrder sorts the points of a region into the order sorted pixels are
+// written back in: "row" (row-major), "col" (column-major) or "radial"
+// (outwards from the region centroid).
+func ScanOrder(region []image.Point, scan string) {
+    switch strings.ToLower(scan) {
+    case "col":
+        sort.Slice(region, func(a, b int) bool {
+            if region[a].X != region[b].X {
+                return region[a].X < region[b].X
+            }
+            return region[a].Y < region[b].Y
+        })
+    case "radial":
+        cx, cy := 0.0, 0.0
+        for _, p := range region {
+            cx += float64(p.X)
+            cy += float64(p.Y)
+        }
+        cx /= float64(len(region))
+        cy /= float64(len(region))
+        distance := func(p image.Point) float64 {
+            dx, dy := float64(p.X)-cx, float64(p.Y)-cy
+            return dx*dx + dy*dy
+        }
+        sort.SliceStable(region, func(a, b int) bool {
+            return distance(region[a]) < distance(region[b])
+        })
+    default:
+        sort.Slice(region, func(a, b int) bool {
+            if region[a].Y != region[b].Y {
+                return region[a].Y < region[b].Y
+            }
+            return region[a].X < region[b].X
+        })
+    }
+}
+
+// SortRegions sorts all pixels of each connected mask region together and
+// writes them back in the scan order of the options.
+func SortRegions(imData *image.NRGBA, mask *image.NRGBA, opts Options) (*image.NRGBA, *image.NRGBA, error) {
+    flags := opts.Flags()
+    mask, err := BuildMask(imData, mask, opts)
+    if err != nil {
+        return nil, nil, err
+    }
+
+    output := image.NewNRGBA(imData.Bounds())
+    draw.Draw(output, output.Rect, imData, imData.Bounds().Min, draw.Src)
+
+    for index, region := range MaskRegions(mask) {
+        ScanOrder(region, opts.Scan)
+        colors := make([]color.Color, len(region))
+        for i, p := range region {
+            colors[i] = imData.At(p.X, p.Y)
+        }
+        rng := psmath.NewRand(psmath.SubSeed(opts.Seed, int64(index)))
+        applySpanOp(colors, flags, &rng)
+        sorted := colors
+        spanColor := psmath.RandomColor(&rng)
+        for i, p := range region {
+            if flags.DEBUG {
+                output.Set(p.X, p.Y, spanColor)
+            } else {
+                output.Set(p.X, p.Y, sorted[i])
+            }
+        }
+    }
+    return output, mask, nil
+}
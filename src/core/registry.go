@@ -0,0 +1,82 @@
+package core
+
+import (
+    "fmt"
+    "image/color"
+
+    psmath "github.com/faceplate-kleo/pixelsorter/lib/math"
+    "github.com/faceplate-kleo/pixelsorter/lib/registry"
+)
+
+func init() {
+    spanOp := func(name, help string, op registry.SpanFunc) {
+        registry.SpanOps.Register(registry.Entry[registry.SpanFunc]{
+            Name: name,
+            Help: help,
+            New: func(registry.Args) (registry.SpanFunc, error) {
+                return op, nil
+            },
+        })
+    }
+    spanOp("sort", "sort the span by the key", func(span []color.Color, sort func([]color.Color), rand func(int) int) {
+        sort(span)
+    })
+    spanOp("peak", "sort the span so it rises to the middle and falls after it", func(span []color.Color, sort func([]color.Color), rand func(int) int) {
+        sort(span)
+        copy(span, psmath.PeakOrder(span))
+    })
+    spanOp("reverse", "mirror the span without sorting it", func(span []color.Color, sort func([]color.Color), rand func(int) int) {
+        for i, j := 0, len(span)-1; i < j; i, j = i+1, j-1 {
+            span[i], span[j] = span[j], span[i]
+        }
+    })
+    spanOp("shuffle", "scatter the pixels of the span randomly", func(span []color.Color, sort func([]color.Color), rand func(int) int) {
+        for i := len(span) - 1; i > 0; i-- {
+            j := rand(i + 1)
+            span[i], span[j] = span[j], span[i]
+        }
+    })
+
+    interval := func(name, help string, place registry.IntervalFunc) {
+        registry.Intervals.Register(registry.Entry[registry.IntervalFunc]{
+            Name: name,
+            Help: help,
+            New: func(registry.Args) (registry.IntervalFunc, error) {
+                return place, nil
+            },
+        })
+    }
+    interval("start", "smear forward from the start of the mask run", func(runStart, runEnd, spanStart, spanEnd, domain int) (int, int) {
+        return spanStart, spanEnd
+    })
+    interval("end", "smear backwards from the end of the mask run", func(runStart, runEnd, spanStart, spanEnd, domain int) (int, int) {
+        length := spanEnd - spanStart
+        spanEnd = psmath.IntMin(runEnd, domain-1)
+        return psmath.IntMax(spanEnd - length, 0), spanEnd
+    })
+    interval("center", "grow both ways around the mask run", centerInterval)
+    interval("bidirectional", "grow both ways, ascending to the middle then descending", centerInterval)
+    registry.Intervals.Register(registry.Entry[registry.IntervalFunc]{
+        Name: "fixed",
+        Help: "spans of a fixed length from the start of each mask run",
+        Params: []registry.Param{
+            {Name: "length", Kind: registry.Int, Default: "32", Help: "span length in pixels"},
+        },
+        New: func(args registry.Args) (registry.IntervalFunc, error) {
+            length := args.Int("length")
+            if length <= 0 {
+                return nil, fmt.Errorf("length %d must be positive", length)
+            }
+            return func(runStart, runEnd, spanStart, spanEnd, domain int) (int, int) {
+                return runStart, psmath.IntMin(runStart + length, domain-1)
+            }, nil
+        },
+    })
+}
+
+func centerInterval(runStart, runEnd, spanStart, spanEnd, domain int) (int, int) {
+    grow := (spanEnd - spanStart) - (runEnd - runStart)
+    spanStart = psmath.IntMax(runStart - grow/2, 0)
+    spanEnd = psmath.IntMin(runEnd + grow - grow/2, domain-1)
+    return spanStart, psmath.IntMax(spanEnd, spanStart)
+}
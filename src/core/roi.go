@@ -0,0 +1,101 @@
+package core
+
+import (
+    "fmt"
+    "image"
+    "image/draw"
+    "strconv"
+    "strings"
+
+    pserrors "github.com/faceplate-kleo/pixelsorter/lib/errors"
+    "github.com/faceplate-kleo/pixelsorter/lib/nrgbautil"
+)
+
+// ParseRegion reads a region of interest given as "x,y,w,h". Colons may be
+// used instead of commas, which is the form pass specs need.
+func ParseRegion(s string) (image.Rectangle, error) {
+    fields := strings.FieldsFunc(s, func(r rune) bool {
+        return r == ',' || r == ':'
+    })
+    if len(fields) != 4 {
+        return image.Rectangle{}, fmt.Errorf("region %q is not of the form x,y,w,h", s)
+    }
+    values := [4]int{}
+    for i, field := range fields {
+        v, err := strconv.Atoi(strings.TrimSpace(field))
+        if err != nil {
+            return image.Rectangle{}, fmt.Errorf("region %q: %w", s, err)
+        }
+        values[i] = v
+    }
+    if values[2] <= 0 || values[3] <= 0 {
+        return image.Rectangle{}, fmt.Errorf("region %q must have a positive size", s)
+    }
+    return image.Rect(values[0], values[1], values[0]+values[2], values[1]+values[3]), nil
+}
+
+// cropRegion clips opts.Region to bounds and returns it along with the
+// options for sorting only that region. A mask in Mask or MaskPath may cover
+// either the whole image or just the region; it is cropped to the region. The
+// returned options have no Region set.
+func (opts Options) cropRegion(bounds image.Rectangle) (image.Rectangle, Options, error) {
+    region := opts.Region.Intersect(bounds)
+    if region.Empty() {
+        return region, opts, fmt.Errorf("%w: region %v lies outside the image %v", pserrors.ErrInvalidOptions, opts.Region, bounds)
+    }
+    opts.Region = image.Rectangle{}
+
+    mask := opts.Mask
+    if mask == nil && opts.MaskPath != "" {
+        loaded, err := nrgbautil.LoadImage(opts.MaskPath)
+        if err != nil {
+            return region, opts, err
+        }
+        mask = loaded
+        opts.MaskPath = ""
+    }
+    if mask == nil {
+        return region, opts, nil
+    }
+
+    nrgba := nrgbautil.ToNrgba(mask)
+    switch mask.Bounds().Size() {
+    case bounds.Size():
+        opts.Mask = nrgbautil.Reorigin(nrgba, bounds.Min).SubImage(region)
+    case region.Size():
+        opts.Mask = nrgbautil.Reorigin(nrgba, region.Min)
+    default:
+        return region, opts, &pserrors.MaskSizeError{Mask: mask.Bounds(), Image: bounds}
+    }
+    return region, opts, nil
+}
+
+// pasteRegion returns a copy of full with sorted drawn over its region.
+func pasteRegion(full, sorted *image.NRGBA) *image.NRGBA {
+    output := image.NewNRGBA(full.Bounds())
+    draw.Draw(output, output.Rect, full, full.Rect.Min, draw.Src)
+    draw.Draw(output, sorted.Rect, sorted, sorted.Rect.Min, draw.Src)
+    return output
+}
+
+// sortRegion sorts only the region of interest. Everything outside it is
+// copied over untouched, and the mask is black there.
+func (s *Sorter) sortRegion(img image.Image) (*image.NRGBA, *image.NRGBA, error) {
+    full := nrgbautil.ToNrgba(img)
+    region, opts, err := s.opts.cropRegion(full.Bounds())
+    if err != nil {
+        return nil, nil, err
+    }
+    sorted, mask, err := (&Sorter{opts: opts}).Sort(full.SubImage(region))
+    if err != nil {
+        return nil, nil, err
+    }
+    if mask == nil {
+        return pasteRegion(full, sorted), nil, nil
+    }
+
+    fullMask := image.NewNRGBA(full.Bounds())
+    draw.Draw(fullMask, fullMask.Rect, image.Black, image.Point{}, draw.Src)
+    draw.Draw(fullMask, mask.Rect, mask, mask.Rect.Min, draw.Src)
+    return pasteRegion(full, sorted), fullMask, nil
+}
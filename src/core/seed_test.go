@@ -0,0 +1,119 @@
+package core
+
+import (
+    "bytes"
+    "context"
+    "encoding/binary"
+    "math"
+    "runtime"
+    "sync"
+    "testing"
+
+    "github.com/faceplate-kleo/pixelsorter/lib/anim"
+)
+
+// testWav is a mono 16 bit PCM .wav stream of a rising tone, seconds long
+// at 8000 Hz.
+func testWav(seconds float64) []byte {
+    const rate = 8000
+    samples := int(seconds * rate)
+    raw := make([]byte, 44+2*samples)
+    copy(raw[0:], "RIFF")
+    binary.LittleEndian.PutUint32(raw[4:], uint32(36+2*samples))
+    copy(raw[8:], "WAVEfmt ")
+    binary.LittleEndian.PutUint32(raw[16:], 16)
+    binary.LittleEndian.PutUint16(raw[20:], 1)
+    binary.LittleEndian.PutUint16(raw[22:], 1)
+    binary.LittleEndian.PutUint32(raw[24:], rate)
+    binary.LittleEndian.PutUint32(raw[28:], 2*rate)
+    binary.LittleEndian.PutUint16(raw[32:], 2)
+    binary.LittleEndian.PutUint16(raw[34:], 16)
+    copy(raw[36:], "data")
+    binary.LittleEndian.PutUint32(raw[40:], uint32(2*samples))
+    for i := 0; i < samples; i++ {
+        t := float64(i) / rate
+        value := 12000 * math.Sin(2*math.Pi*(200+900*t)*t)
+        binary.LittleEndian.PutUint16(raw[44+2*i:], uint16(int16(value)))
+    }
+    return raw
+}
+
+// withGOMAXPROCS runs render at GOMAXPROCS 1 and then at 4.
+func withGOMAXPROCS(t *testing.T, render func() []byte) (one, many []byte) {
+    t.Helper()
+    previous := runtime.GOMAXPROCS(1)
+    defer runtime.GOMAXPROCS(previous)
+    one = render()
+    runtime.GOMAXPROCS(4)
+    many = render()
+    return one, many
+}
+
+func TestSortPassesSameAtAnyGOMAXPROCS(t *testing.T) {
+    img := testImage(64, 48, 5)
+    first := DefaultOptions()
+    first.NoiseFactor = 6
+    first.Seed = 99
+    first.Mask = testMask(64, 48)
+    second := first
+    second.Direction = "down"
+    second.Anchor = "center"
+    passes := []Pass{{Options: first}, {Options: second, RecomputeMask: true}}
+
+    one, many := withGOMAXPROCS(t, func() []byte {
+        //sorts on several goroutines at once share nothing but the input
+        results := make([][]byte, 4)
+        var wg sync.WaitGroup
+        for i := range results {
+            wg.Add(1)
+            go func(i int) {
+                defer wg.Done()
+                sorted, _, err := SortPasses(img, passes)
+                if err != nil {
+                    t.Error(err)
+                    return
+                }
+                results[i] = sorted.Pix
+            }(i)
+        }
+        wg.Wait()
+        for i := 1; i < len(results); i++ {
+            if !bytes.Equal(results[i], results[0]) {
+                t.Fatalf("concurrent sort %d differs from the first", i)
+            }
+        }
+        return results[0]
+    })
+    if !bytes.Equal(one, many) {
+        t.Fatal("SortPasses differs between GOMAXPROCS 1 and 4")
+    }
+}
+
+func TestWaveAnimationSameAtAnyGOMAXPROCS(t *testing.T) {
+    //wide enough and striped, so that the signal does not stretch every
+    //span to the edge and noise shows
+    img := testImage(200, 40, 6)
+    wav := testWav(0.5)
+    opts := DefaultOptions()
+    opts.Mask = testMask(200, 40)
+    opts.NoiseFactor = 4
+    opts.Seed = 1234
+
+    one, many := withGOMAXPROCS(t, func() []byte {
+        var out bytes.Buffer
+        sink := anim.NewGifSink(&out, nil)
+        if err := WaveAnimation(context.Background(), img, bytes.NewReader(wav), sink, opts, 25, 16, nil); err != nil {
+            t.Fatal(err)
+        }
+        if err := sink.Close(); err != nil {
+            t.Fatal(err)
+        }
+        return out.Bytes()
+    })
+    if len(one) == 0 {
+        t.Fatal("no animation written")
+    }
+    if !bytes.Equal(one, many) {
+        t.Fatal("WaveAnimation differs between 1 and 4 workers")
+    }
+}
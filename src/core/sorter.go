@@ -0,0 +1,324 @@
+package core
+
+import (
+    "errors"
+    "fmt"
+    "image"
+    "math"
+    "strconv"
+    "strings"
+
+    pserrors "github.com/faceplate-kleo/pixelsorter/lib/errors"
+    f "github.com/faceplate-kleo/pixelsorter/lib/flags"
+    psmath "github.com/faceplate-kleo/pixelsorter/lib/math"
+    "github.com/faceplate-kleo/pixelsorter/lib/nrgbautil"
+    "github.com/faceplate-kleo/pixelsorter/lib/registry"
+)
+
+// Options describes a single sort. The zero value is not useful on its own;
+// start from DefaultOptions and change what is needed.
+type Options struct {
+    // Direction of the sort smear: up, down, left or right.
+    Direction string
+    // Key names the registered sort key, e.g. "mean", "red" or "hue".
+    Key string
+    Descend bool
+    Crush bool
+
+    // Mask source. MaskPath is read when set, then Mask is used as is, and
+    // otherwise the registered mask generator MaskGen builds one. Threshold
+    // and Invert are the parameters of the "contrast" generator. Mask must
+    // have the size of the image being sorted.
+    Threshold int
+    Invert bool
+    Mask image.Image
+    MaskPath string
+    MaskGen string
+
+    // Interval settings. Spans are Scalar times the length of their mask
+    // run, offset by up to NoiseFactor pixels of noise and by Signal.
+    Scalar float64
+    NoiseFactor int
+    Signal []int
+    Clean bool
+    // Anchor names the registered interval that places spans on mask runs,
+    // and SpanOp the registered op applied to every span.
+    Anchor string
+    SpanOp string
+    // Params are the parameters of the registered entries in use, by name.
+    // Entries ignore the names they do not declare.
+    Params map[string]string
+
+    // Mode is "span" for regular span sorting, "tiles" for tile sorting,
+    // "rows"/"cols" to reorder whole lines by an aggregate key, or "regions"
+    // to sort connected mask regions as a whole.
+    Mode string
+    // TileOp is "sort" to sort inside each tile or "arrange" to reorder
+    // whole tiles by their average key.
+    TileOp string
+    // Grid is the number of tiles across and down, Block a fixed tile size
+    // in pixels. Block wins when both are set.
+    Grid image.Point
+    Block image.Point
+    // Aggregate is the line key used by the rows and cols modes.
+    Aggregate string
+    // Scan is the order sorted pixels are written back into a region: "row",
+    // "col" or "radial".
+    Scan string
+
+    // Region limits sorting to a rectangle of the image, in image
+    // coordinates. Pixels outside it are left as they are. The zero
+    // rectangle sorts the whole image.
+    Region image.Rectangle
+
+    // Seed drives all randomness: noise and debug colors. The same seed gives
+    // identical output. Zero picks a random seed, see Sorter.Options.
+    Seed int64
+
+    // Debugging aids: fill spans with random colors, or white out the mask.
+    DebugSpans bool
+    DebugMask bool
+}
+
+func DefaultOptions() Options {
+    return Options{
+        Direction: "right",
+        Key: "mean",
+        Threshold: 110,
+        MaskGen: "contrast",
+        Scalar: 3.0,
+        Anchor: "start",
+        SpanOp: "sort",
+        Mode: "span",
+        TileOp: "sort",
+        Aggregate: "mean",
+        Scan: "row",
+    }
+}
+
+// OptionsFromFlags carries the sorting related fields of flags over to the
+// default options.
+func OptionsFromFlags(flags f.Flags) Options {
+    opts := DefaultOptions()
+    opts.Key = "mean"
+    if flags.GRAY_RED_COMPARE {
+        opts.Key = "red"
+    } else if !flags.MEAN_COMPARE {
+        opts.Key = ""
+    }
+    opts.Descend = flags.DESCEND
+    opts.Crush = flags.CRUSH
+    opts.Invert = flags.INVERT
+    opts.Clean = flags.CLEAN
+    if flags.ANCHOR != "" {
+        opts.Anchor = flags.ANCHOR
+    }
+    opts.DebugSpans = flags.DEBUG
+    opts.DebugMask = flags.MASK_DEBUG
+    return opts
+}
+
+// Flags returns the flags the lower level sorting functions expect, with the
+// registry entries named by the options resolved. Names that can not be
+// resolved are left out; Validate reports them.
+func (opts Options) Flags() f.Flags {
+    flags := f.Flags{
+        DEBUG: opts.DebugSpans,
+        MASK_DEBUG: opts.DebugMask,
+        DESCEND: opts.Descend,
+        CRUSH: opts.Crush,
+        CLEAN: opts.Clean,
+        INVERT: opts.Invert,
+        MEAN_COMPARE: opts.Key == "mean",
+        GRAY_RED_COMPARE: opts.Key == "red",
+        ANCHOR: opts.Anchor,
+    }
+    params := opts.params()
+    if opts.Key != "" {
+        flags.KEY, _ = registry.Keys.New(opts.Key, params)
+    }
+    if opts.SpanOp != "" {
+        flags.SPAN_OP, _ = registry.SpanOps.New(opts.SpanOp, params)
+    }
+    if opts.Anchor != "" {
+        flags.INTERVAL, _ = registry.Intervals.New(opts.Anchor, params)
+    }
+    return flags
+}
+
+// params merges the parameters that have options of their own with Params,
+// which wins.
+func (opts Options) params() map[string]string {
+    params := map[string]string{
+        "threshold": strconv.Itoa(opts.Threshold),
+        "invert": strconv.FormatBool(opts.Invert),
+    }
+    for name, value := range opts.Params {
+        params[strings.ToLower(name)] = value
+    }
+    return params
+}
+
+func (opts Options) maskFunc() (registry.MaskFunc, error) {
+    name := opts.MaskGen
+    if name == "" {
+        name = "contrast"
+    }
+    return registry.Masks.New(name, opts.params())
+}
+
+func (opts Options) Validate() error {
+    problems := []string{}
+    if !ValidDirection(opts.Direction) {
+        problems = append(problems, fmt.Sprintf("unknown direction %q", opts.Direction))
+    }
+    params := opts.params()
+    if opts.Key != "" {
+        if _, err := registry.Keys.New(opts.Key, params); err != nil {
+            problems = append(problems, err.Error())
+        }
+    }
+    if _, err := opts.maskFunc(); err != nil {
+        problems = append(problems, err.Error())
+    }
+    if opts.Anchor != "" {
+        if _, err := registry.Intervals.New(opts.Anchor, params); err != nil {
+            problems = append(problems, err.Error())
+        }
+    }
+    if opts.SpanOp != "" {
+        if _, err := registry.SpanOps.New(opts.SpanOp, params); err != nil {
+            problems = append(problems, err.Error())
+        }
+    }
+    if !ValidMode(opts.Mode) {
+        problems = append(problems, fmt.Sprintf("unknown mode %q", opts.Mode))
+    }
+    if opts.TileOp != "" && opts.TileOp != "sort" && opts.TileOp != "arrange" {
+        problems = append(problems, fmt.Sprintf("unknown tile op %q", opts.TileOp))
+    }
+    if opts.Aggregate != "" && !ValidAggregate(opts.Aggregate) {
+        problems = append(problems, lineAggregateError(opts.Aggregate).Error())
+    }
+    if !ValidScan(opts.Scan) {
+        problems = append(problems, fmt.Sprintf("unknown scan order %q", opts.Scan))
+    }
+    //NoiseFactor may be negative, which spreads noise both ways
+    if opts.Scalar < 0 || math.IsNaN(opts.Scalar) || math.IsInf(opts.Scalar, 0) {
+        problems = append(problems, fmt.Sprintf("scalar must be a number of at least 0, got %v", opts.Scalar))
+    }
+    if opts.Grid.X < 0 || opts.Grid.Y < 0 {
+        problems = append(problems, fmt.Sprintf("tiles must not be negative, got %dx%d", opts.Grid.X, opts.Grid.Y))
+    }
+    if opts.Block.X < 0 || opts.Block.Y < 0 {
+        problems = append(problems, fmt.Sprintf("block must not be negative, got %dx%d", opts.Block.X, opts.Block.Y))
+    }
+    if len(problems) > 0 {
+        return fmt.Errorf("%w: %s", pserrors.ErrInvalidOptions, strings.Join(problems, "; "))
+    }
+    return nil
+}
+
+// orientation is the direction the sort works in. Line and region modes work
+// on the image as is.
+func (opts Options) orientation() string {
+    if opts.Mode == "rows" || opts.Mode == "cols" || opts.Mode == "regions" {
+        return "right"
+    }
+    return opts.Direction
+}
+
+// Sorter sorts images with a fixed set of options. It holds no per-image
+// state and can be reused for any number of images.
+type Sorter struct {
+    opts Options
+    intoState
+}
+
+func NewSorter(opts Options) (*Sorter, error) {
+    opts.Direction = strings.ToLower(opts.Direction)
+    opts.Mode = strings.ToLower(opts.Mode)
+    opts.Anchor = strings.ToLower(opts.Anchor)
+    if opts.Mode == "" {
+        opts.Mode = "span"
+    }
+    if opts.Seed == 0 {
+        opts.Seed = psmath.RandomSeed()
+    }
+    if err := opts.Validate(); err != nil {
+        return nil, err
+    }
+    s := &Sorter{opts: opts}
+    if err := s.prepare(); err != nil {
+        return nil, err
+    }
+    return s, nil
+}
+
+// Options returns the options in use, including the seed that was picked if
+// none was given.
+func (s *Sorter) Options() Options {
+    return s.opts
+}
+
+// Sort sorts the image and returns the result together with the mask that was
+// used, both in the orientation and bounds of the input. The image may have
+// any origin, and a mask only needs to match its size.
+func (s *Sorter) Sort(img image.Image) (*image.NRGBA, *image.NRGBA, error) {
+    if img == nil {
+        return nil, nil, errors.New("no image to sort")
+    }
+    if !s.opts.Region.Empty() {
+        return s.sortRegion(img)
+    }
+    var mask *image.NRGBA
+    if s.opts.Mask != nil && s.opts.MaskPath == "" {
+        if s.opts.Mask.Bounds().Size() != img.Bounds().Size() {
+            return nil, nil, &pserrors.MaskSizeError{Mask: s.opts.Mask.Bounds(), Image: img.Bounds()}
+        }
+        mask = nrgbautil.Reorigin(nrgbautil.ToNrgba(s.opts.Mask), img.Bounds().Min)
+        mask = OrientNrgba(mask, s.opts.orientation())
+    }
+    sorted, used, err := s.sort(nrgbautil.ToNrgba(img), mask)
+    if err != nil {
+        return nil, nil, err
+    }
+    if used == nil {
+        return sorted, nil, nil
+    }
+    return sorted, RestoreNrgba(used, s.opts.orientation()), nil
+}
+
+// Mask returns the mask Sort would use for img, in the orientation and bounds
+// of the input, without sorting anything.
+func (s *Sorter) Mask(img image.Image) (*image.NRGBA, error) {
+    if img == nil {
+        return nil, errors.New("no image to mask")
+    }
+    if s.opts.Mask != nil && s.opts.MaskPath == "" {
+        if s.opts.Mask.Bounds().Size() != img.Bounds().Size() {
+            return nil, &pserrors.MaskSizeError{Mask: s.opts.Mask.Bounds(), Image: img.Bounds()}
+        }
+        return nrgbautil.Reorigin(nrgbautil.ToNrgba(s.opts.Mask), img.Bounds().Min), nil
+    }
+    oriented := OrientNrgba(nrgbautil.ToNrgba(img), s.opts.orientation())
+    mask, err := BuildMask(oriented, nil, s.opts)
+    if err != nil {
+        return nil, err
+    }
+    return RestoreNrgba(mask, s.opts.orientation()), nil
+}
+
+// sort dispatches on the mode. The mask, if any, is in the sort orientation
+// and the mask returned is too.
+func (s *Sorter) sort(imData *image.NRGBA, mask *image.NRGBA) (*image.NRGBA, *image.NRGBA, error) {
+    switch s.opts.Mode {
+    case "tiles":
+        return SortTiles(imData, mask, s.opts)
+    case "rows", "cols":
+        return SortLines(imData, mask, s.opts)
+    case "regions":
+        return SortRegions(imData, mask, s.opts)
+    }
+    return SortSpans(imData, mask, s.opts)
+}
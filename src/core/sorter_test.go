@@ -0,0 +1,107 @@
+package core
+
+import (
+    "bytes"
+    "errors"
+    "image"
+    "math"
+    "path/filepath"
+    "testing"
+
+    pserrors "github.com/faceplate-kleo/pixelsorter/lib/errors"
+    f "github.com/faceplate-kleo/pixelsorter/lib/flags"
+    "github.com/faceplate-kleo/pixelsorter/lib/nrgbautil"
+)
+
+func TestMaskPathWinsOverMask(t *testing.T) {
+    img := testImage(40, 30, 3)
+    path := filepath.Join(t.TempDir(), "mask.png")
+    if err := nrgbautil.WriteFile(testMask(40, 30), path); err != nil {
+        t.Fatal(err)
+    }
+    for _, direction := range []string{"right", "down"} {
+        opts := DefaultOptions()
+        opts.Direction = direction
+        opts.Seed = 7
+        opts.MaskPath = path
+        opts.Mask = image.NewNRGBA(img.Rect)
+        sorter, err := NewSorter(opts)
+        if err != nil {
+            t.Fatal(err)
+        }
+        want, err := sorter.Mask(img)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if !bytes.Equal(want.Pix, testMask(40, 30).Pix) {
+            t.Fatalf("%s: Mask did not read MaskPath", direction)
+        }
+        sorted, used, err := sorter.Sort(img)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if !bytes.Equal(used.Pix, want.Pix) {
+            t.Fatalf("%s: Sort and Mask used different masks", direction)
+        }
+        dst := image.NewNRGBA(img.Rect)
+        if err := sorter.SortInto(dst, img); err != nil {
+            t.Fatal(err)
+        }
+        if !bytes.Equal(dst.Pix, sorted.Pix) {
+            t.Fatalf("%s: SortInto and Sort used different masks", direction)
+        }
+    }
+}
+
+func TestAnchorIgnoresCase(t *testing.T) {
+    img := testImage(40, 30, 4)
+    sorted := map[string][]byte{}
+    for _, anchor := range []string{"bidirectional", "Bidirectional"} {
+        opts := DefaultOptions()
+        opts.Anchor = anchor
+        opts.Seed = 9
+        sorter, err := NewSorter(opts)
+        if err != nil {
+            t.Fatal(err)
+        }
+        out, _, err := sorter.Sort(img)
+        if err != nil {
+            t.Fatal(err)
+        }
+        sorted[anchor] = out.Pix
+    }
+    if !bytes.Equal(sorted["bidirectional"], sorted["Bidirectional"]) {
+        t.Fatal("Bidirectional sorts differently from bidirectional")
+    }
+}
+
+func TestAnchorSpanRejectsUnknownAnchor(t *testing.T) {
+    if _, _, err := AnchorSpan(2, 2, 5, 9, 20, f.Flags{ANCHOR: "sideways"}); err == nil {
+        t.Fatal("unknown anchor accepted")
+    }
+    start, end, err := AnchorSpan(2, 2, 5, 9, 20, f.Flags{ANCHOR: "start"})
+    if err != nil || start != 2 || end != 9 {
+        t.Fatalf("start anchor: got %d-%d, %v", start, end, err)
+    }
+}
+
+func TestValidateRejectsNegativeSizes(t *testing.T) {
+    broken := map[string]func(*Options){
+        "scalar": func(o *Options) { o.Scalar = -2 },
+        "nan scalar": func(o *Options) { o.Scalar = math.NaN() },
+        "tiles": func(o *Options) { o.Mode, o.Grid = "tiles", image.Pt(-3, 2) },
+        "block": func(o *Options) { o.Mode, o.Block = "tiles", image.Pt(4, -4) },
+    }
+    for name, breakOpts := range broken {
+        opts := DefaultOptions()
+        breakOpts(&opts)
+        if err := opts.Validate(); !errors.Is(err, pserrors.ErrInvalidOptions) {
+            t.Errorf("%s: got %v, want ErrInvalidOptions", name, err)
+        }
+    }
+    opts := DefaultOptions()
+    opts.NoiseFactor = -7
+    if err := opts.Validate(); err != nil {
+        t.Errorf("negative noise: %v", err)
+    }
+}
@@ -0,0 +1,152 @@
+package core
+
+import (
+    "fmt"
+    "image"
+    "image/draw"
+    "sort"
+    "strconv"
+    "strings"
+
+    f "github.com/faceplate-kleo/pixelsorter/lib/flags"
+    psmath "github.com/faceplate-kleo/pixelsorter/lib/math"
+)
+
+// ParseSize reads a "WxH" pair such as "8x8".
+func ParseSize(s string) (image.Point, error) {
+    ws, hs, ok := strings.Cut(strings.ToLower(s), "x")
+    if !ok {
+        return image.Point{}, fmt.Errorf("size %q is not of the form WxH", s)
+    }
+    w, err := strconv.Atoi(ws)
+    if err != nil {
+        return image.Point{}, fmt.Errorf("size %q: %w", s, err)
+    }
+    h, err := strconv.Atoi(hs)
+    if err != nil {
+        return image.Point{}, fmt.Errorf("size %q: %w", s, err)
+    }
+    if w <= 0 || h <= 0 {
+        return image.Point{}, fmt.Errorf("size %q must be positive", s)
+    }
+    return image.Pt(w, h), nil
+}
+
+// TileSize works out the pixel size of a tile. A non-zero block size is used
+// as is, otherwise the bounds are divided into a grid of cols x rows tiles.
+func TileSize(bounds image.Rectangle, grid, block image.Point) image.Point {
+    if block.X > 0 && block.Y > 0 {
+        return block
+    }
+    cols := psmath.IntMax(grid.X, 1)
+    rows := psmath.IntMax(grid.Y, 1)
+    return image.Pt(psmath.IntMax(bounds.Dx()/cols, 1), psmath.IntMax(bounds.Dy()/rows, 1))
+}
+
+// SortTiles is the "tiles" mode. With the "arrange" tile op whole tiles are
+// reordered by their average key along the sort direction, otherwise every
+// tile is span sorted on its own.
+func SortTiles(imData *image.NRGBA, mask *image.NRGBA, opts Options) (*image.NRGBA, *image.NRGBA, error) {
+    flags := opts.Flags()
+    size := TileSize(imData.Bounds(), opts.Grid, opts.Block)
+    direction := strings.ToLower(opts.Direction)
+    if direction == "up" || direction == "down" {
+        size = image.Pt(size.Y, size.X)
+    }
+
+    oriented := OrientNrgba(imData, direction)
+    mask, err := BuildMask(oriented, mask, opts)
+    if err != nil {
+        return nil, nil, err
+    }
+
+    var sorted *image.NRGBA
+    if opts.TileOp == "arrange" {
+        sorted = ArrangeTiles(oriented, size, flags)
+    } else {
+        sorted = SortWithinTilesSeeded(oriented, mask, size, opts.Scalar, opts.NoiseFactor, flags, opts.Seed)
+    }
+    return RestoreNrgba(sorted, direction), mask, nil
+}
+
+// SortWithinTiles is SortWithinTilesSeeded with a random seed.
+func SortWithinTiles(imData, mask *image.NRGBA, size image.Point, scalar float64, noiseFactor int, flags f.Flags) *image.NRGBA {
+    return SortWithinTilesSeeded(imData, mask, size, scalar, noiseFactor, flags, psmath.RandomSeed())
+}
+
+// SortWithinTilesSeeded sorts spans inside every tile of size, so that no
+// span crosses a tile edge. Every tile draws from its own seed derived from
+// seed.
+func SortWithinTilesSeeded(imData, mask *image.NRGBA, size image.Point, scalar float64, noiseFactor int, flags f.Flags, seed int64) *image.NRGBA {
+    bounds := imData.Bounds()
+    output := image.NewNRGBA(bounds)
+    tile_index := int64(0)
+
+    for y := bounds.Min.Y; y < bounds.Max.Y; y += size.Y {
+        for x := bounds.Min.X; x < bounds.Max.X; x += size.X {
+            rect := image.Rect(x, y, x+size.X, y+size.Y).Intersect(bounds)
+            local := image.Rect(0, 0, rect.Dx(), rect.Dy())
+
+            tile := image.NewNRGBA(local)
+            draw.Draw(tile, local, imData, rect.Min, draw.Src)
+            tileMask := image.NewNRGBA(local)
+            draw.Draw(tileMask, local, mask, rect.Min, draw.Src)
+
+            sorted := CreateSortedFromMaskSeeded(tile, tileMask, scalar, noiseFactor, nil, flags, psmath.SubSeed(seed, tile_index))
+            tile_index++
+            draw.Draw(output, rect, sorted, image.Point{}, draw.Src)
+        }
+    }
+    return output
+}
+
+func ArrangeTiles(imData *image.NRGBA, size image.Point, flags f.Flags) *image.NRGBA {
+    bounds := imData.Bounds()
+    output := image.NewNRGBA(bounds)
+    draw.Draw(output, bounds, imData, bounds.Min, draw.Src)
+
+    //partial tiles at the right and bottom edges are left where they are
+    cols := bounds.Dx() / size.X
+    rows := bounds.Dy() / size.Y
+
+    for row := 0; row < rows; row++ {
+        y := bounds.Min.Y + row*size.Y
+        tiles := make([]image.Rectangle, cols)
+        keys := make([]float64, cols)
+        for col := 0; col < cols; col++ {
+            x := bounds.Min.X + col*size.X
+            tiles[col] = image.Rect(x, y, x+size.X, y+size.Y)
+            keys[col] = AverageKey(imData, tiles[col], flags)
+        }
+
+        order := make([]int, cols)
+        for i := range order {
+            order[i] = i
+        }
+        sort.SliceStable(order, func(a, b int) bool {
+            if flags.DESCEND {
+                return keys[order[a]] > keys[order[b]]
+            }
+            return keys[order[a]] < keys[order[b]]
+        })
+
+        for col, from := range order {
+            draw.Draw(output, tiles[col], imData, tiles[from].Min, draw.Src)
+        }
+    }
+    return output
+}
+
+// AverageKey is the mean sort key of all pixels inside rect.
+func AverageKey(imData image.Image, rect image.Rectangle, flags f.Flags) float64 {
+    if rect.Empty() {
+        return 0
+    }
+    total := 0.0
+    for y := rect.Min.Y; y < rect.Max.Y; y++ {
+        for x := rect.Min.X; x < rect.Max.X; x++ {
+            total += float64(psmath.ColorKey(imData.At(x, y), flags))
+        }
+    }
+    return total / float64(rect.Dx()*rect.Dy())
+}
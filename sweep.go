@@ -0,0 +1,424 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "image"
+    "math"
+    "os"
+    "runtime"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    pserrors "github.com/faceplate-kleo/pixelsorter/lib/errors"
+    "github.com/faceplate-kleo/pixelsorter/lib/nrgbautil"
+    "github.com/faceplate-kleo/pixelsorter/lib/sheet"
+    "github.com/faceplate-kleo/pixelsorter/src/core"
+)
+
+const (
+    defaultSweepOut = "./sweep.png"
+    // maxSweepCells keeps a typo in a range from rendering for hours.
+    maxSweepCells = 400
+)
+
+// sweepSetting writes one value of a swept setting into a pass. numeric
+// settings also accept start:end:step ranges.
+type sweepSetting struct {
+    numeric bool
+    apply func(p *core.RecipePass, value string) error
+}
+
+var sweepSettings = map[string]sweepSetting{
+    "threshold": {true, func(p *core.RecipePass, value string) (err error) {
+        p.Mask.Threshold, err = strconv.Atoi(value)
+        return err
+    }},
+    "noise": {true, func(p *core.RecipePass, value string) (err error) {
+        p.Interval.Noise, err = strconv.Atoi(value)
+        return err
+    }},
+    "scalar": {true, func(p *core.RecipePass, value string) (err error) {
+        p.Interval.Scalar, err = strconv.ParseFloat(value, 64)
+        return err
+    }},
+    "key": {false, func(p *core.RecipePass, value string) error {
+        p.Key = value
+        return nil
+    }},
+    "direction": {false, func(p *core.RecipePass, value string) error {
+        p.Direction = value
+        return nil
+    }},
+    "anchor": {false, func(p *core.RecipePass, value string) error {
+        p.Interval.Anchor = value
+        return nil
+    }},
+    "span_op": {false, func(p *core.RecipePass, value string) error {
+        p.SpanOp = value
+        return nil
+    }},
+    "mask_gen": {false, func(p *core.RecipePass, value string) error {
+        p.Mask.Generator = value
+        return nil
+    }},
+}
+
+// sweepAxis is one swept setting and the values it takes. param is set for
+// the parameters of registered entries, given with -param name=range.
+type sweepAxis struct {
+    name string
+    param bool
+    values []string
+}
+
+func (a sweepAxis) apply(p *core.RecipePass, value string) error {
+    if a.param {
+        params := map[string]string{}
+        for name, v := range p.Params {
+            params[name] = v
+        }
+        params[a.name] = value
+        p.Params = params
+        return nil
+    }
+    if err := sweepSettings[a.name].apply(p, value); err != nil {
+        return fmt.Errorf("%s: %q is not a valid value", a.name, value)
+    }
+    return nil
+}
+
+// sweepIndex is the JSON index of a sheet. Cells are in the order of the
+// sheet, row by row.
+type sweepIndex struct {
+    Sheet string `json:"sheet"`
+    Input string `json:"input"`
+    Seed int64 `json:"seed"`
+    // Scale is the size of a cell image relative to the input.
+    Scale float64 `json:"scale"`
+    Columns int `json:"columns"`
+    Rows int `json:"rows"`
+    Axes []sweepIndexAxis `json:"axes"`
+    Cells []sweepIndexCell `json:"cells"`
+}
+
+type sweepIndexAxis struct {
+    Name string `json:"name"`
+    Values []string `json:"values"`
+}
+
+type sweepIndexCell struct {
+    Row int `json:"row"`
+    Column int `json:"column"`
+    // X, Y, Width and Height locate the cell image on the sheet.
+    X int `json:"x"`
+    Y int `json:"y"`
+    Width int `json:"width"`
+    Height int `json:"height"`
+    Values map[string]string `json:"values"`
+    // Recipe renders the cell at full resolution.
+    Recipe *core.Recipe `json:"recipe"`
+}
+
+func runSweep(args []string) error {
+    axes, args, err := sweepAxes(args)
+    if err != nil {
+        return err
+    }
+    c := newRenderCmd("sweep", "Render every combination of swept settings at reduced size, as one labelled grid. "+
+        "Sweep -threshold, -scalar and -noise with start:end:step ranges or a,b,c lists, -key, -direction, -anchor, -span_op "+
+        "and -mask_gen with a,b,c lists, and registered parameters with -param name=start:end:step.", defaultSweepOut)
+    indexPath := ""
+    cellSize := 256
+    columns := 0
+    labelScale := 2
+    workers := runtime.NumCPU()
+    c.fs.StringVar(&indexPath, "index", "", "Write a JSON index mapping every cell to its exact settings - does not write if unspecified")
+    c.fs.IntVar(&cellSize, "cell", cellSize, "Longest side of each cell in pixels; 0 renders at full size")
+    c.fs.IntVar(&columns, "columns", 0, "Cells per row (default the number of values of the first swept setting)")
+    c.fs.IntVar(&labelScale, "label_scale", labelScale, "Size of the label font")
+    c.fs.IntVar(&workers, "workers", workers, "Number of cells rendered at once")
+    c.registerFormat()
+    c.preview.register(c.fs)
+    c.fs.Parse(args)
+    if len(axes) == 0 {
+        return fmt.Errorf("%w: nothing to sweep, give a range such as -threshold 60:200:20", pserrors.ErrInvalidOptions)
+    }
+    if workers < 1 {
+        return fmt.Errorf("%w: workers must be at least 1, got %d", pserrors.ErrInvalidOptions, workers)
+    }
+    if indexPath == "-" {
+        return fmt.Errorf("%w: -index can not be standard output, give it a file", pserrors.ErrInvalidOptions)
+    }
+    total := 1
+    for _, axis := range axes {
+        total *= len(axis.values)
+    }
+    if total > maxSweepCells {
+        return fmt.Errorf("%w: sweep has %d cells, at most %d are allowed", pserrors.ErrInvalidOptions, total, maxSweepCells)
+    }
+    if columns <= 0 {
+        columns = len(axes[0].values)
+    }
+
+    recipe, err := c.recipe(nil)
+    if err != nil {
+        return err
+    }
+    if c.saveOnly(recipe) {
+        return nil
+    }
+    full, _, err := loadRecipe(recipe)
+    if err != nil {
+        return err
+    }
+    small := nrgbautil.Downscale(full, cellSize)
+    if small != full {
+        for _, pass := range recipe.Passes {
+            if pass.Mask.Path != "" || pass.Region != "" {
+                return fmt.Errorf("%w: -mask and -region are drawn against the full image, use them with -cell 0", pserrors.ErrInvalidOptions)
+            }
+        }
+    }
+
+    cells := make([]sweepIndexCell, total)
+    passes := make([][]core.Pass, total)
+    labels := make([]string, total)
+    for i := range cells {
+        cellRecipe, values, label, err := sweepCombination(recipe, axes, i)
+        if err != nil {
+            return err
+        }
+        if passes[i], err = cellRecipe.ToPasses(); err != nil {
+            return fmt.Errorf("%s: %w", label, err)
+        }
+        cells[i] = sweepIndexCell{Row: i / columns, Column: i % columns, Values: values, Recipe: cellRecipe}
+        labels[i] = label
+    }
+
+    images, err := renderSweep(small, passes, workers)
+    if err != nil {
+        return err
+    }
+    sheetCells := make([]sheet.Cell, total)
+    for i := range sheetCells {
+        sheetCells[i] = sheet.Cell{Image: images[i], Label: labels[i]}
+    }
+    out, layout := sheet.Compose(sheetCells, columns, labelScale)
+    outPath := orDefault(recipe.Output, defaultSweepOut)
+    if err := nrgbautil.WriteFileFormat(out, outPath, recipe.Format); err != nil {
+        return err
+    }
+    if err := c.preview.show(out); err != nil {
+        return err
+    }
+
+    if indexPath == "" {
+        return nil
+    }
+    index := sweepIndex{
+        Sheet: outPath,
+        Input: recipe.Input,
+        Seed: recipe.Seed,
+        Scale: float64(small.Bounds().Dx()) / float64(full.Bounds().Dx()),
+        Columns: layout.Columns,
+        Rows: layout.Rows,
+        Cells: cells,
+    }
+    for _, axis := range axes {
+        index.Axes = append(index.Axes, sweepIndexAxis{Name: axis.name, Values: axis.values})
+    }
+    for i, rect := range layout.Cells {
+        index.Cells[i].X, index.Cells[i].Y = rect.Min.X, rect.Min.Y
+        index.Cells[i].Width, index.Cells[i].Height = rect.Dx(), rect.Dy()
+    }
+    return writeJSON(indexPath, index)
+}
+
+// sweepCombination is the recipe of the i-th cell, with the first axis
+// changing fastest, together with the swept values and the cell label.
+func sweepCombination(recipe *core.Recipe, axes []sweepAxis, i int) (*core.Recipe, map[string]string, string, error) {
+    cell := *recipe
+    cell.Output = ""
+    cell.MaskOutput = ""
+    cell.Passes = append([]core.RecipePass(nil), recipe.Passes...)
+    values := map[string]string{}
+    label := []string{}
+    for _, axis := range axes {
+        value := axis.values[i%len(axis.values)]
+        i /= len(axis.values)
+        for p := range cell.Passes {
+            if err := axis.apply(&cell.Passes[p], value); err != nil {
+                return nil, nil, "", err
+            }
+        }
+        values[axis.name] = value
+        label = append(label, axis.name+"="+value)
+    }
+    return &cell, values, strings.Join(label, " "), nil
+}
+
+// renderSweep sorts the image once for every set of passes.
+func renderSweep(imData *image.NRGBA, passes [][]core.Pass, workers int) ([]*image.NRGBA, error) {
+    images := make([]*image.NRGBA, len(passes))
+    errs := make([]error, len(passes))
+    jobs := make(chan int)
+    finished := make(chan int)
+    var wg sync.WaitGroup
+    for w := 0; w < workers; w++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            for i := range jobs {
+                images[i], _, errs[i] = core.SortPasses(imData, passes[i])
+                finished <- i
+            }
+        }()
+    }
+    go func() {
+        for i := range passes {
+            jobs <- i
+        }
+        close(jobs)
+        wg.Wait()
+        close(finished)
+    }()
+
+    progress := progressBar("sweep", "cells")
+    start := time.Now()
+    done := 0
+    for range finished {
+        done++
+        progress(core.Progress{Done: done, Total: len(passes), Elapsed: time.Since(start)})
+    }
+    for _, err := range errs {
+        if err != nil {
+            return nil, err
+        }
+    }
+    return images, nil
+}
+
+// sweepAxes takes the swept settings out of args and returns the rest for
+// the flag set. A setting is swept when its value is a range or a list;
+// single values are left for the flags.
+func sweepAxes(args []string) ([]sweepAxis, []string, error) {
+    axes := []sweepAxis{}
+    rest := []string{}
+    for i := 0; i < len(args); i++ {
+        arg := args[i]
+        if arg == "--" {
+            rest = append(rest, args[i:]...)
+            break
+        }
+        //bare arguments are values of the flag before them
+        if !strings.HasPrefix(arg, "-") {
+            rest = append(rest, arg)
+            continue
+        }
+        name, value, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+        setting, known := sweepSettings[name]
+        if !known && name != "param" {
+            rest = append(rest, arg)
+            continue
+        }
+        consumed := 0
+        if !hasValue {
+            if i+1 == len(args) {
+                rest = append(rest, arg)
+                continue
+            }
+            value, consumed = args[i+1], 1
+        }
+
+        axis := sweepAxis{name: name}
+        spec := value
+        if name == "param" {
+            param, paramSpec, ok := strings.Cut(value, "=")
+            axis.name, axis.param, spec = strings.ToLower(strings.TrimSpace(param)), true, paramSpec
+            setting.numeric = ok
+        }
+        if !strings.Contains(spec, ",") && !(setting.numeric && strings.Contains(spec, ":")) {
+            rest = append(rest, args[i:i+1+consumed]...)
+            i += consumed
+            continue
+        }
+        values, err := sweepValues(spec, setting.numeric)
+        if err != nil {
+            return nil, nil, fmt.Errorf("%w: -%s %s: %v", pserrors.ErrInvalidOptions, name, value, err)
+        }
+        for _, other := range axes {
+            if other.name == axis.name {
+                return nil, nil, fmt.Errorf("%w: %s is swept twice", pserrors.ErrInvalidOptions, axis.name)
+            }
+        }
+        axis.values = values
+        axes = append(axes, axis)
+        i += consumed
+    }
+    return axes, rest, nil
+}
+
+// sweepValues expands a,b,c lists and, for numeric settings, inclusive
+// start:end:step ranges. The step defaults to 1.
+func sweepValues(spec string, numeric bool) ([]string, error) {
+    if !numeric || !strings.Contains(spec, ":") {
+        values := []string{}
+        for _, value := range strings.Split(spec, ",") {
+            if value = strings.TrimSpace(value); value != "" {
+                values = append(values, value)
+            }
+        }
+        if len(values) == 0 {
+            return nil, fmt.Errorf("no values")
+        }
+        return values, nil
+    }
+
+    parts := strings.Split(spec, ":")
+    if len(parts) < 2 || len(parts) > 3 {
+        return nil, fmt.Errorf("range must be start:end or start:end:step")
+    }
+    if len(parts) == 2 {
+        parts = append(parts, "1")
+    }
+    bounds := make([]float64, 3)
+    for i, part := range parts {
+        v, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+        if err != nil {
+            return nil, fmt.Errorf("%q is not a number", part)
+        }
+        bounds[i] = v
+    }
+    start, end, step := bounds[0], bounds[1], bounds[2]
+    if step == 0 || (end-start)/step < 0 {
+        return nil, fmt.Errorf("step %v never gets from %v to %v", step, start, end)
+    }
+    count := int(math.Floor((end-start)/step+1e-9)) + 1
+    if count > maxSweepCells {
+        return nil, fmt.Errorf("range has %d values, at most %d are allowed", count, maxSweepCells)
+    }
+    values := make([]string, count)
+    for i := range values {
+        //multiplying instead of adding keeps 0.1 steps from drifting
+        v := start + float64(i)*step
+        values[i] = strconv.FormatFloat(math.Round(v*1e9)/1e9, 'f', -1, 64)
+    }
+    return values, nil
+}
+
+func writeJSON(path string, v any) error {
+    file, err := os.Create(path)
+    if err != nil {
+        return pserrors.IO("create", path, err)
+    }
+    encoder := json.NewEncoder(file)
+    encoder.SetIndent("", "  ")
+    if err := encoder.Encode(v); err != nil {
+        file.Close()
+        return pserrors.IO("encode", path, err)
+    }
+    return pserrors.IO("close", path, file.Close())
+}
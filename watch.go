@@ -0,0 +1,249 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "image"
+    "os"
+    "os/signal"
+    "strings"
+    "time"
+
+    "github.com/faceplate-kleo/pixelsorter/lib/nrgbautil"
+    "github.com/faceplate-kleo/pixelsorter/src/core"
+)
+
+// fileStamp is what the watcher compares between polls.
+type fileStamp struct {
+    size int64
+    modified time.Time
+    missing bool
+}
+
+func stampOf(path string) fileStamp {
+    info, err := os.Stat(path)
+    if err != nil {
+        return fileStamp{missing: true}
+    }
+    return fileStamp{size: info.Size(), modified: info.ModTime()}
+}
+
+func (s fileStamp) String() string {
+    return fmt.Sprintf("%d@%d", s.size, s.modified.UnixNano())
+}
+
+// watcher polls files by size and modification time.
+type watcher struct {
+    stamps map[string]fileStamp
+}
+
+func newWatcher() *watcher {
+    return &watcher{stamps: map[string]fileStamp{}}
+}
+
+// changed reports which of paths differ from the last poll. Paths seen for
+// the first time are recorded without counting as changed.
+func (w *watcher) changed(paths []string) []string {
+    changed := []string{}
+    for _, path := range paths {
+        stamp := stampOf(path)
+        last, seen := w.stamps[path]
+        w.stamps[path] = stamp
+        if seen && stamp != last {
+            changed = append(changed, path)
+        }
+    }
+    return changed
+}
+
+// recipeFiles are the files the recipe of a command is built from.
+func (c *renderCmd) recipeFiles() []string {
+    files := []string{}
+    if c.recipePath != "" {
+        files = append(files, c.recipePath)
+    }
+    if c.preset != "" {
+        if path, err := core.PresetPath(c.preset); err == nil {
+            files = append(files, path)
+        }
+    }
+    return files
+}
+
+// inputFiles are the files a recipe reads when it renders.
+func inputFiles(recipe *core.Recipe) []string {
+    files := []string{recipe.Input}
+    for _, pass := range recipe.Passes {
+        if pass.Mask.Path != "" {
+            files = append(files, pass.Mask.Path)
+        }
+    }
+    if recipe.Animation != nil && recipe.Animation.Audio != nil {
+        files = append(files, recipe.Animation.Audio.Wav)
+    }
+    return files
+}
+
+// registerWatch adds -watch and its poll interval.
+func (c *renderCmd) registerWatch() {
+    c.fs.BoolVar(&c.watch, "watch", false, "Keep running and render again whenever the input, mask, .wav, recipe or preset file changes")
+    c.fs.DurationVar(&c.watchInterval, "watch_interval", 500*time.Millisecond, "How often -watch checks the files")
+}
+
+// watchLoop renders once, then again whenever a file it depends on changes,
+// until ctrl-c. A changed recipe or preset file rebuilds the recipe with
+// build, keeping the seed unless the recipe sets one and without writing
+// -dump-recipe or -save-preset again. Errors are reported and watching goes
+// on.
+func (c *renderCmd) watchLoop(recipe *core.Recipe, build func() (*core.Recipe, error), render func(*core.Recipe) error) error {
+    ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+    defer stop()
+
+    files := newWatcher()
+    report := func(err error) error {
+        if errors.Is(err, context.Canceled) {
+            return err
+        }
+        if err != nil {
+            fmt.Fprintln(os.Stderr, "ERROR:", err)
+            return nil
+        }
+        fmt.Fprintf(os.Stderr, "rendered at %s\n", time.Now().Format("15:04:05"))
+        return nil
+    }
+    if err := report(render(recipe)); err != nil {
+        return err
+    }
+    files.changed(append(c.recipeFiles(), inputFiles(recipe)...))
+    fmt.Fprintln(os.Stderr, "watching for changes, ctrl-c to stop")
+
+    ticker := time.NewTicker(c.watchInterval)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-ctx.Done():
+            return nil
+        case <-ticker.C:
+        }
+        if ctx.Err() != nil {
+            return nil
+        }
+        rebuild := len(files.changed(c.recipeFiles())) > 0
+        changed := files.changed(inputFiles(recipe))
+        if !rebuild && len(changed) == 0 {
+            continue
+        }
+        if rebuild {
+            c.fallbackSeed = recipe.Seed
+            c.rebuilt = true
+            next, err := build()
+            //take in anything the rebuild wrote itself
+            files.changed(c.recipeFiles())
+            if err != nil {
+                report(err)
+                continue
+            }
+            recipe = next
+            files.changed(inputFiles(recipe))
+        }
+        if err := report(render(recipe)); err != nil {
+            return err
+        }
+    }
+}
+
+// stillCache keeps the decoded input and the mask of the first pass between
+// renders, so that watch mode only redoes what changed.
+type stillCache struct {
+    inputKey string
+    input *image.NRGBA
+    maskKey string
+    mask *image.NRGBA
+}
+
+// load is loadRecipe, reusing the input image while the file is unchanged.
+// A nil cache loads everything.
+func (cache *stillCache) load(recipe *core.Recipe) (*image.NRGBA, []core.Pass, error) {
+    if cache == nil {
+        return loadRecipe(recipe)
+    }
+    key := fmt.Sprintf("%s|%s|%t|%d", recipe.Input, stampOf(recipe.Input), recipe.SourceDebug, recipe.Seed)
+    if key != cache.inputKey {
+        imData, passes, err := loadRecipe(recipe)
+        if err != nil {
+            return nil, nil, err
+        }
+        cache.inputKey, cache.input = key, imData
+        cache.maskKey, cache.mask = "", nil
+        return imData, passes, nil
+    }
+    passes, err := recipe.ToPasses()
+    return cache.input, passes, err
+}
+
+// reuseMask hands the first pass the mask of the last render when neither
+// the input nor the mask settings of that pass have changed. Passes that
+// would sort without a mask are left alone, a mask would change them.
+func (cache *stillCache) reuseMask(imData *image.NRGBA, recipe *core.Recipe, passes []core.Pass) error {
+    if cache == nil || passes[0].Region != (image.Rectangle{}) || !buildsMask(passes[0].Options) {
+        return nil
+    }
+    first := recipe.Passes[0]
+    key := fmt.Sprintf("%s|%+v|%v|%s|%s|%t", cache.inputKey, first.Mask, first.Params, first.Direction, first.Mode, first.DebugMask)
+    if first.Mask.Path != "" {
+        key += "|" + stampOf(first.Mask.Path).String()
+    }
+    if key != cache.maskKey {
+        sorter, err := core.NewSorter(passes[0].Options)
+        if err != nil {
+            return err
+        }
+        mask, err := sorter.Mask(imData)
+        if err != nil {
+            return err
+        }
+        cache.maskKey, cache.mask = key, mask
+    }
+    passes[0].Mask = cache.mask
+    passes[0].MaskPath = ""
+    return nil
+}
+
+// buildsMask reports whether a pass of its own builds a mask: every mode but
+// rows and cols, which only do with a mask file or the mask aggregate.
+func buildsMask(opts core.Options) bool {
+    switch strings.ToLower(opts.Mode) {
+    case "rows", "cols":
+        return opts.MaskPath != "" || strings.EqualFold(opts.Aggregate, "mask")
+    }
+    return true
+}
+
+// renderStill sorts a recipe into a still image and writes it, with the mask
+// if asked, and previews it.
+func renderStill(recipe *core.Recipe, cache *stillCache, preview *previewFlags) error {
+    imData, passes, err := cache.load(recipe)
+    if err != nil {
+        return err
+    }
+    if err := cache.reuseMask(imData, recipe, passes); err != nil {
+        return err
+    }
+    sorted, mask, err := core.SortPasses(imData, passes)
+    if err != nil {
+        return err
+    }
+    if err := nrgbautil.WriteFileFormat(sorted, orDefault(recipe.Output, defaultStillOut), recipe.Format); err != nil {
+        return err
+    }
+    if recipe.MaskOutput != "" {
+        if mask == nil {
+            return errNoMask
+        }
+        if err := nrgbautil.WriteFileFormat(mask, recipe.MaskOutput, recipe.Format); err != nil {
+            return err
+        }
+    }
+    return preview.show(sorted)
+}